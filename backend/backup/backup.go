@@ -0,0 +1,653 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"yana-back/blobstore"
+	"yana-back/migrations"
+	"yana-back/vault"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	// CheckInterval is how often scheduled snapshots are checked for being due
+	CheckInterval = time.Hour
+
+	ManifestFile  = "manifest.json"
+	DatabaseFile  = "yana-db.sqlite"
+	AttachmentDir = "attachments"
+
+	// attempts bounds how often a snapshot is retaken when a blob it refers to was
+	// deleted while it was copied
+	attempts = 3
+)
+
+// Kind tells why a snapshot was taken; scheduled kinds are rotated separately
+type Kind string
+
+const (
+	Manual  Kind = "manual"
+	Daily   Kind = "daily"
+	Weekly  Kind = "weekly"
+	Monthly Kind = "monthly"
+)
+
+// Manifest describes the content of a snapshot, for it to be checked before a restore
+type Manifest struct {
+	Kind          Kind      `json:"kind"`
+	CreatedAt     time.Time `json:"createdAt"`
+	SchemaVersion int       `json:"schemaVersion"`
+	// Vault is set when the snapshot holds the vault file its data is encrypted with
+	Vault    bool     `json:"vault"`
+	Database Database `json:"database"`
+	Blobs    []Blob   `json:"blobs"`
+}
+
+type Database struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Blob is a stored content of the snapshot; its key is the hash of its bytes
+type Blob struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// Snapshot is a complete backup in the backup directory
+type Snapshot struct {
+	Name string `json:"name"`
+	Path string `json:"-"`
+	Manifest
+}
+
+// Size is the space the snapshot's files take, counting linked blobs in full
+func (s Snapshot) Size() int64 {
+	size := s.Database.Size
+	for _, blob := range s.Blobs {
+		size += blob.Size
+	}
+	return size
+}
+
+// Retention is how many snapshots of each scheduled kind are kept, 0 takes none
+type Retention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// Enabled reports whether any snapshots are scheduled
+func (r Retention) Enabled() bool {
+	return r.Daily > 0 || r.Weekly > 0 || r.Monthly > 0
+}
+
+// Source is the data directory being backed up
+type Source struct {
+	DB             *gorm.DB
+	AttachmentPath string
+	DataDir        string
+}
+
+// Target is the data directory a snapshot is restored into
+type Target struct {
+	DatabasePath   string
+	AttachmentPath string
+	DataDir        string
+}
+
+// Manager takes snapshots of a data directory into a backup directory, which may be
+// done while the backend serves requests
+type Manager struct {
+	Dir       string
+	Retention Retention
+	Source    Source
+
+	mu sync.Mutex
+}
+
+func New(dir string, retention Retention, source Source) *Manager {
+	return &Manager{Dir: dir, Retention: retention, Source: source}
+}
+
+// Create takes a snapshot. The database is copied in one read transaction and the
+// blobs are linked or copied around it, so the snapshot is consistent while writes
+// go on.
+func (m *Manager) Create(ctx context.Context, kind Kind) (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s", kind, now.Format("20060102-150405"))
+	path := filepath.Join(m.Dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s already exists", name)
+	}
+
+	// Built under a hidden name, so an interrupted snapshot is never listed
+	tmp := filepath.Join(m.Dir, ".tmp-"+name)
+	if err := os.RemoveAll(tmp); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to clear snapshot directory: %w", err)
+	}
+	if err := os.MkdirAll(tmp, 0o700); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	manifest, err := m.write(ctx, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return Snapshot{}, err
+	}
+	manifest.Kind = kind
+	manifest.CreatedAt = now
+
+	if err := writeManifest(tmp, manifest); err != nil {
+		os.RemoveAll(tmp)
+		return Snapshot{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.RemoveAll(tmp)
+		return Snapshot{}, fmt.Errorf("failed to store snapshot: %w", err)
+	}
+
+	return Snapshot{Name: name, Path: path, Manifest: manifest}, nil
+}
+
+// List returns the snapshots in the backup directory, newest first
+func (m *Manager) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(m.Dir, entry.Name())
+		manifest, err := readManifest(path)
+		if err != nil {
+			log.Printf("Skipping snapshot %s: %v", entry.Name(), err)
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Name: entry.Name(), Path: path, Manifest: manifest})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// Scheduled takes the snapshot that is due, if any, and deletes the scheduled
+// snapshots beyond the retention. A monthly snapshot counts as the week's and the
+// day's as well, and a weekly one as the day's.
+func (m *Manager) Scheduled(ctx context.Context) error {
+	if !m.Retention.Enabled() {
+		return nil
+	}
+
+	snapshots, err := m.List()
+	if err != nil {
+		return err
+	}
+
+	if kind := dueKind(snapshots, m.Retention, time.Now()); kind != "" {
+		snapshot, err := m.Create(ctx, kind)
+		if err != nil {
+			return fmt.Errorf("failed to take %s snapshot: %w", kind, err)
+		}
+		log.Printf("Took %s snapshot %s", kind, snapshot.Name)
+		snapshots = append([]Snapshot{snapshot}, snapshots...)
+	}
+
+	return m.rotate(snapshots)
+}
+
+// Verify checks a snapshot against its manifest: the database must be intact and
+// not newer than this backend, and every blob present with the content its key names
+func Verify(path string) (Manifest, error) {
+	manifest, err := readManifest(path)
+	if err != nil {
+		return manifest, err
+	}
+
+	dbPath := filepath.Join(path, DatabaseFile)
+	digest, err := hashFile(dbPath)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read database: %w", err)
+	}
+	if digest != manifest.Database {
+		return manifest, errors.New("database does not match the manifest")
+	}
+
+	db, err := openSnapshotDatabase(dbPath)
+	if err != nil {
+		return manifest, err
+	}
+	defer closeDatabase(db)
+
+	var results []string
+	if err := db.Raw("PRAGMA integrity_check").Scan(&results).Error; err != nil {
+		return manifest, fmt.Errorf("failed to check database: %w", err)
+	}
+	if len(results) != 1 || results[0] != "ok" {
+		return manifest, fmt.Errorf("database is corrupt: %s", strings.Join(results, "; "))
+	}
+
+	version, err := migrations.Version(db)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > migrations.Latest() {
+		return manifest, fmt.Errorf("%w: it has version %d, this backend supports up to %d", migrations.ErrNewerSchema, version, migrations.Latest())
+	}
+
+	referenced, err := blobKeys(db)
+	if err != nil {
+		return manifest, err
+	}
+	listed := make(map[string]bool, len(manifest.Blobs))
+	for _, blob := range manifest.Blobs {
+		listed[blob.Key] = true
+	}
+	for _, key := range referenced {
+		if !listed[key] {
+			return manifest, fmt.Errorf("blob %s is missing from the manifest", key)
+		}
+	}
+
+	store := blobstore.OpenFileStore(filepath.Join(path, AttachmentDir))
+	for _, blob := range manifest.Blobs {
+		if err := checkBlob(store, blob); err != nil {
+			return manifest, err
+		}
+	}
+
+	if manifest.Vault {
+		if _, err := os.Stat(filepath.Join(path, vault.FileName)); err != nil {
+			return manifest, fmt.Errorf("vault file is missing: %w", err)
+		}
+	}
+
+	return manifest, nil
+}
+
+// Restore verifies a snapshot and swaps it in as the target's data. The database and
+// vault file are staged next to the ones they replace and swapped in together; those
+// replaced are kept with a .before-restore suffix, or put back if the swap fails. The
+// backend must not be running on the target.
+func Restore(path string, target Target) (Manifest, error) {
+	manifest, err := Verify(path)
+	if err != nil {
+		return manifest, fmt.Errorf("snapshot check failed: %w", err)
+	}
+
+	// Blobs first: extra ones are harmless and collected later
+	src := blobstore.OpenFileStore(filepath.Join(path, AttachmentDir))
+	dst, err := blobstore.NewFileStore(target.AttachmentPath)
+	if err != nil {
+		return manifest, err
+	}
+	for _, blob := range manifest.Blobs {
+		if err := src.CopyTo(dst, blob.Key); err != nil {
+			return manifest, fmt.Errorf("failed to restore blob %s: %w", blob.Key, err)
+		}
+	}
+
+	vaultPath := filepath.Join(target.DataDir, vault.FileName)
+	staged := []stagedFile{{target.DatabasePath + ".restoring", target.DatabasePath}}
+	if manifest.Vault {
+		staged = append(staged, stagedFile{vaultPath + ".restoring", vaultPath})
+	}
+	defer func() {
+		for _, file := range staged {
+			os.Remove(file.staged)
+		}
+	}()
+
+	if err := copyFile(filepath.Join(path, DatabaseFile), staged[0].staged); err != nil {
+		return manifest, fmt.Errorf("failed to copy database: %w", err)
+	}
+	if manifest.Vault {
+		if err := copyFile(filepath.Join(path, vault.FileName), staged[1].staged); err != nil {
+			return manifest, fmt.Errorf("failed to copy vault file: %w", err)
+		}
+	}
+
+	// A journal left by a crash belongs to the database it moves aside with. The vault
+	// file goes even when the snapshot has none, its key would not open the database.
+	replaced := []string{target.DatabasePath, target.DatabasePath + "-journal", vaultPath}
+	suffix := ".before-restore-" + time.Now().Format("20060102-150405")
+	return manifest, swapIn(staged, replaced, suffix)
+}
+
+// Helper functions
+
+// write fills dir with the blobs, database and vault file of the source
+func (m *Manager) write(ctx context.Context, dir string) (Manifest, error) {
+	var manifest Manifest
+
+	src := blobstore.OpenFileStore(m.Source.AttachmentPath)
+	dst, err := blobstore.NewFileStore(filepath.Join(dir, AttachmentDir))
+	if err != nil {
+		return manifest, err
+	}
+
+	// Every blob the database copy can refer to is either stored by now or written
+	// after this walk, and picked up below
+	err = src.Walk(func(key string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := src.CopyTo(dst, key); err != nil && !errors.Is(err, blobstore.ErrNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return manifest, fmt.Errorf("failed to copy blobs: %w", err)
+	}
+
+	dbPath := filepath.Join(dir, DatabaseFile)
+	for attempt := 1; ; attempt++ {
+		manifest, err = m.copyDatabase(dbPath, src, dst)
+		if err == nil || !errors.Is(err, blobstore.ErrNotFound) || attempt == attempts {
+			break
+		}
+		// A blob the copy refers to was deleted meanwhile, so a newer copy does not
+		// refer to it anymore
+		log.Printf("Retaking database snapshot: %v", err)
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	if manifest.Database, err = hashFile(dbPath); err != nil {
+		return manifest, fmt.Errorf("failed to hash database: %w", err)
+	}
+
+	vaultPath := filepath.Join(m.Source.DataDir, vault.FileName)
+	if _, err := os.Stat(vaultPath); err == nil {
+		if err := copyFile(vaultPath, filepath.Join(dir, vault.FileName)); err != nil {
+			return manifest, fmt.Errorf("failed to copy vault file: %w", err)
+		}
+		manifest.Vault = true
+	}
+
+	return manifest, nil
+}
+
+// copyDatabase writes a consistent copy of the database to path and makes sure dst
+// holds exactly the blobs it refers to
+func (m *Manager) copyDatabase(path string, src, dst *blobstore.FileStore) (Manifest, error) {
+	var manifest Manifest
+
+	os.Remove(path)
+	if err := m.Source.DB.Exec("VACUUM INTO ?", path).Error; err != nil {
+		return manifest, fmt.Errorf("failed to copy database: %w", err)
+	}
+
+	db, err := openSnapshotDatabase(path)
+	if err != nil {
+		return manifest, err
+	}
+	defer closeDatabase(db)
+
+	if manifest.SchemaVersion, err = migrations.Version(db); err != nil {
+		return manifest, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	keys, err := blobKeys(db)
+	if err != nil {
+		return manifest, err
+	}
+
+	referenced := make(map[string]bool, len(keys))
+	manifest.Blobs = make([]Blob, 0, len(keys))
+	for _, key := range keys {
+		if err := src.CopyTo(dst, key); err != nil {
+			return manifest, fmt.Errorf("failed to copy blob %s: %w", key, err)
+		}
+		blob, err := dst.Open(key)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Blobs = append(manifest.Blobs, Blob{Key: key, Size: blob.Size()})
+		blob.Close()
+		referenced[key] = true
+	}
+
+	// Blobs written after the walk but deleted before the copy are not needed
+	err = dst.Walk(func(key string) error {
+		if referenced[key] {
+			return nil
+		}
+		return dst.Delete(key)
+	})
+	return manifest, err
+}
+
+// rotate deletes the oldest scheduled snapshots of each kind beyond the retention
+func (m *Manager) rotate(snapshots []Snapshot) error {
+	keep := map[Kind]int{Daily: m.Retention.Daily, Weekly: m.Retention.Weekly, Monthly: m.Retention.Monthly}
+	kept := make(map[Kind]int)
+
+	// Newest first
+	for _, snapshot := range snapshots {
+		limit, scheduled := keep[snapshot.Kind]
+		if !scheduled {
+			continue
+		}
+		if kept[snapshot.Kind] < limit {
+			kept[snapshot.Kind]++
+			continue
+		}
+		if err := os.RemoveAll(snapshot.Path); err != nil {
+			return fmt.Errorf("failed to delete snapshot %s: %w", snapshot.Name, err)
+		}
+		log.Printf("Deleted %s snapshot %s", snapshot.Kind, snapshot.Name)
+	}
+	return nil
+}
+
+// dueKind returns the kind of snapshot to take now: the largest one whose period has
+// none of its kind or a larger one yet
+func dueKind(snapshots []Snapshot, retention Retention, now time.Time) Kind {
+	tiers := []struct {
+		kind   Kind
+		keep   int
+		period func(t time.Time) string
+	}{
+		{Monthly, retention.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{Weekly, retention.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{Daily, retention.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+	}
+
+	for i, tier := range tiers {
+		if tier.keep <= 0 {
+			continue
+		}
+
+		taken := false
+		for _, snapshot := range snapshots {
+			for _, larger := range tiers[:i+1] {
+				if snapshot.Kind == larger.kind && tier.period(snapshot.CreatedAt.In(now.Location())) == tier.period(now) {
+					taken = true
+				}
+			}
+		}
+		if !taken {
+			return tier.kind
+		}
+	}
+	return ""
+}
+
+func openSnapshotDatabase(path string) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open("file:"+path+"?mode=ro"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database copy: %w", err)
+	}
+	return db, nil
+}
+
+func closeDatabase(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+// blobKeys lists the blobs the database refers to
+func blobKeys(db *gorm.DB) ([]string, error) {
+	if !db.Migrator().HasTable("blobs") {
+		return nil, nil
+	}
+
+	var keys []string
+	if err := db.Raw("SELECT key FROM blobs ORDER BY key").Scan(&keys).Error; err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	return keys, nil
+}
+
+func checkBlob(store *blobstore.FileStore, blob Blob) error {
+	stored, err := store.Open(blob.Key)
+	if err != nil {
+		return fmt.Errorf("blob %s: %w", blob.Key, err)
+	}
+	size := stored.Size()
+	stored.Close()
+
+	if size != blob.Size {
+		return fmt.Errorf("blob %s has %d bytes, the manifest says %d", blob.Key, size, blob.Size)
+	}
+	return store.Verify(blob.Key)
+}
+
+func readManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+	raw, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+func writeManifest(dir string, manifest Manifest) error {
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+func hashFile(path string) (Database, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Database{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return Database{}, err
+	}
+	return Database{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// copyFile copies src to dst and flushes it to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// stagedFile is a restored file written next to the file it replaces
+type stagedFile struct {
+	staged string
+	path   string
+}
+
+// swapIn renames the replaced files that exist by appending suffix, then moves the
+// staged files into place. A failure undoes the renames done so far.
+func swapIn(staged []stagedFile, replaced []string, suffix string) (err error) {
+	var movedAside, installed []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, path := range installed {
+			os.Remove(path)
+		}
+		for _, path := range movedAside {
+			if err := os.Rename(path+suffix, path); err != nil {
+				log.Printf("Failed to put %s back: %v", path, err)
+			}
+		}
+	}()
+
+	for _, path := range replaced {
+		err := os.Rename(path, path+suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", filepath.Base(path), err)
+		}
+		movedAside = append(movedAside, path)
+	}
+
+	for _, file := range staged {
+		if err := os.Rename(file.staged, file.path); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", filepath.Base(file.path), err)
+		}
+		installed = append(installed, file.path)
+	}
+	return nil
+}
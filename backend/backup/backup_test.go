@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDueKind(t *testing.T) {
+	retention := Retention{Daily: 7, Weekly: 4, Monthly: 12}
+	// A Wednesday, in the ISO week after the one the month started in
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	monthStart := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+	weekStart := time.Date(2026, 10, 12, 3, 0, 0, 0, time.UTC)
+	today := time.Date(2026, 10, 14, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		snapshots []Snapshot
+		retention Retention
+		want      Kind
+	}{
+		{"first snapshot", nil, retention, Monthly},
+		{"monthly taken", []Snapshot{snapshotAt(Monthly, monthStart)}, retention, Weekly},
+		{"weekly taken", []Snapshot{snapshotAt(Weekly, weekStart), snapshotAt(Monthly, monthStart)}, retention, Daily},
+		{"daily taken", []Snapshot{snapshotAt(Daily, today), snapshotAt(Weekly, weekStart), snapshotAt(Monthly, monthStart)}, retention, ""},
+		{"monthly counts as weekly and daily", []Snapshot{snapshotAt(Monthly, today)}, retention, ""},
+		{"daily does not count as weekly", []Snapshot{snapshotAt(Daily, today), snapshotAt(Monthly, monthStart)}, retention, Weekly},
+		{"manual does not count", []Snapshot{snapshotAt(Manual, today)}, retention, Monthly},
+		{"last month's monthly", []Snapshot{snapshotAt(Monthly, monthStart.AddDate(0, 0, -1))}, retention, Monthly},
+		{"monthly not kept", nil, Retention{Daily: 7, Weekly: 4}, Weekly},
+		{"only daily kept", []Snapshot{snapshotAt(Monthly, today)}, Retention{Daily: 7}, ""},
+		{"nothing kept", nil, Retention{}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := dueKind(test.snapshots, test.retention, now); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRotateKeepsNewestOfEachKind(t *testing.T) {
+	dir := t.TempDir()
+	m := New(dir, Retention{Daily: 2, Weekly: 1, Monthly: 1}, Source{})
+
+	// Newest first, as List returns them
+	now := time.Now()
+	var snapshots []Snapshot
+	for i, kind := range []Kind{Daily, Manual, Daily, Weekly, Daily, Monthly, Weekly, Manual, Monthly} {
+		snapshot := snapshotAt(kind, now.Add(-time.Duration(i)*time.Hour))
+		snapshot.Name = fmt.Sprintf("%s-%d", kind, i)
+		snapshot.Path = filepath.Join(dir, snapshot.Name)
+		if err := os.Mkdir(snapshot.Path, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	if err := m.rotate(snapshots); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	want := []string{"daily-0", "daily-2", "manual-1", "manual-7", "monthly-5", "weekly-3"}
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+}
+
+func TestSwapIn(t *testing.T) {
+	const suffix = ".before-restore"
+
+	tests := []struct {
+		name       string
+		stageVault bool
+		wantErr    bool
+		wantDB     string
+		wantVault  string
+		wantAside  bool
+	}{
+		{"swapped in", true, false, "restored db", "restored vault", true},
+		{"rolled back", false, true, "current db", "current vault", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := filepath.Join(dir, "notes.db")
+			vaultPath := filepath.Join(dir, "vault")
+			writeFile(t, db, "current db")
+			writeFile(t, vaultPath, "current vault")
+			writeFile(t, db+".restoring", "restored db")
+			if test.stageVault {
+				writeFile(t, vaultPath+".restoring", "restored vault")
+			}
+
+			staged := []stagedFile{{db + ".restoring", db}, {vaultPath + ".restoring", vaultPath}}
+			// The journal does not exist and is skipped
+			err := swapIn(staged, []string{db, db + "-journal", vaultPath}, suffix)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, test.wantErr)
+			}
+
+			if got := readFile(t, db); got != test.wantDB {
+				t.Errorf("database holds %q, want %q", got, test.wantDB)
+			}
+			if got := readFile(t, vaultPath); got != test.wantVault {
+				t.Errorf("vault file holds %q, want %q", got, test.wantVault)
+			}
+			for _, path := range []string{db, vaultPath} {
+				_, err := os.Stat(path + suffix)
+				if kept := err == nil; kept != test.wantAside {
+					t.Errorf("%s kept aside: %v, want %v", filepath.Base(path), kept, test.wantAside)
+				}
+			}
+		})
+	}
+}
+
+func snapshotAt(kind Kind, createdAt time.Time) Snapshot {
+	return Snapshot{Manifest: Manifest{Kind: kind, CreatedAt: createdAt}}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
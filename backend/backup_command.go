@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"yana-back/backup"
+	"yana-back/config"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const backupUsage = "Usage: yana-back backup <create|list|verify <snapshot>|restore <snapshot>> [flags] <data dir>"
+
+// runBackupCommand handles `yana-back backup create` and `list`, which work while the
+// backend runs, `verify` to check a snapshot and `restore` to swap one in while the
+// backend is stopped. Snapshots are given by path or by name in the backup directory.
+func runBackupCommand(args []string) {
+	if len(args) < 2 {
+		log.Fatal(backupUsage)
+	}
+
+	command, args := args[0], args[1:]
+	var snapshot string
+	if command == "verify" || command == "restore" {
+		if len(args) < 2 {
+			log.Fatal(backupUsage)
+		}
+		snapshot, args = args[0], args[1:]
+	}
+
+	cfg, err := config.Load(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch command {
+	case "create":
+		err = createSnapshot(cfg)
+	case "list":
+		err = listSnapshots(cfg)
+	case "verify":
+		err = verifySnapshot(snapshotPath(cfg, snapshot))
+	case "restore":
+		err = restoreSnapshot(cfg, snapshotPath(cfg, snapshot))
+	default:
+		err = errors.New(backupUsage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// createSnapshot takes a manual snapshot without locking the data directory, so a
+// running backend goes on serving meanwhile
+func createSnapshot(cfg config.Config) error {
+	dbPath := cfg.DatabasePath()
+	if _, err := os.Stat(dbPath); err != nil {
+		return fmt.Errorf("no database to back up: %w", err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+
+	snapshot, err := newBackupManager(cfg, db).Create(context.Background(), backup.Manual)
+	if err != nil {
+		return fmt.Errorf("failed to take snapshot: %w", err)
+	}
+	log.Printf("Snapshot written to %s (%d blobs, %d bytes)", snapshot.Path, len(snapshot.Blobs), snapshot.Size())
+	return nil
+}
+
+func listSnapshots(cfg config.Config) error {
+	snapshots, err := newBackupManager(cfg, nil).List()
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		fmt.Printf("%s\t%s\t%s\t%d blobs\t%d bytes\n", snapshot.Name, snapshot.Kind,
+			snapshot.CreatedAt.Format("2006-01-02 15:04:05"), len(snapshot.Blobs), snapshot.Size())
+	}
+	return nil
+}
+
+func verifySnapshot(path string) error {
+	manifest, err := backup.Verify(path)
+	if err != nil {
+		return fmt.Errorf("snapshot check failed: %w", err)
+	}
+	log.Printf("Snapshot %s is intact (schema version %d, %d blobs)", path, manifest.SchemaVersion, len(manifest.Blobs))
+	return nil
+}
+
+// restoreSnapshot swaps a snapshot in; taking the data directory lock makes sure no
+// backend is using it
+func restoreSnapshot(cfg config.Config, path string) error {
+	lock, err := lockDataDir(cfg)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	manifest, err := backup.Restore(path, backup.Target{
+		DatabasePath:   cfg.DatabasePath(),
+		AttachmentPath: cfg.AttachmentPath(),
+		DataDir:        cfg.DataDir,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored the %s snapshot from %s, the replaced database is kept next to it",
+		manifest.Kind, manifest.CreatedAt.Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+// snapshotPath accepts a snapshot's path or its name in the backup directory
+func snapshotPath(cfg config.Config, snapshot string) string {
+	if _, err := os.Stat(snapshot); err == nil || filepath.IsAbs(snapshot) {
+		return snapshot
+	}
+	return filepath.Join(cfg.BackupPath(), snapshot)
+}
@@ -0,0 +1,283 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// Store keeps file contents outside the database, addressed by the hex SHA-256 of
+// the stored bytes
+type Store interface {
+	// Create starts a new blob; the key is known once it is committed
+	Create() (Writer, error)
+	Open(key string) (Blob, error)
+	Delete(key string) error
+	// Walk calls fn with the key of every stored blob
+	Walk(fn func(key string) error) error
+}
+
+// Writer receives the content of a new blob
+type Writer interface {
+	io.Writer
+	// Commit stores the blob and returns its key and stored size
+	Commit() (key string, size int64, err error)
+	// Abort discards the blob
+	Abort() error
+}
+
+// Blob is a stored content opened for reading
+type Blob interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// FileStore keeps blobs as files in a directory, sharded by the first two characters
+// of their key
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore opens the blob directory, creating it if needed, and clears uploads
+// left over from a previous run
+func NewFileStore(dir string) (*FileStore, error) {
+	store := &FileStore{dir: dir}
+
+	if err := os.RemoveAll(store.tmpDir()); err != nil {
+		return nil, fmt.Errorf("failed to clear unfinished uploads: %w", err)
+	}
+	if err := os.MkdirAll(store.tmpDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	return store, nil
+}
+
+// OpenFileStore opens an existing blob directory for reading, leaving uploads in
+// progress alone, e.g. while another process serves it
+func OpenFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (s *FileStore) Create() (Writer, error) {
+	file, err := os.CreateTemp(s.tmpDir(), "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blob: %w", err)
+	}
+
+	return &fileWriter{store: s, file: file, hash: sha256.New()}, nil
+}
+
+func (s *FileStore) Open(key string) (Blob, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat blob: %w", err)
+	}
+
+	return &fileBlob{File: file, size: info.Size()}, nil
+}
+
+func (s *FileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) Walk(fn func(key string) error) error {
+	shards, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	for _, shard := range shards {
+		if !shard.IsDir() || len(shard.Name()) != 2 {
+			continue // The tmp directory
+		}
+
+		entries, err := os.ReadDir(filepath.Join(s.dir, shard.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, entry := range entries {
+			key := entry.Name()
+			if entry.Type().IsRegular() && validKey(key) && key[:2] == shard.Name() {
+				if err := fn(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CopyTo stores the blob in dst as well. The file is hard linked when both stores are
+// on the same file system, blobs are never changed in place, and copied otherwise.
+func (s *FileStore) CopyTo(dst *FileStore, key string) error {
+	src, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	target, _ := dst.path(key)
+
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := os.Link(src, target); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	blob, err := s.Open(key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	w, err := dst.Create()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, blob); err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to copy blob: %w", err)
+	}
+	copied, _, err := w.Commit()
+	if err != nil {
+		return err
+	}
+	if copied != key {
+		dst.Delete(copied)
+		return fmt.Errorf("blob %s does not match its key", key)
+	}
+	return nil
+}
+
+// Verify checks that the stored blob still hashes to its key
+func (s *FileStore) Verify(key string) error {
+	blob, err := s.Open(key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, blob); err != nil {
+		return fmt.Errorf("failed to read blob: %w", err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != key {
+		return fmt.Errorf("blob %s does not match its key", key)
+	}
+	return nil
+}
+
+// Helper functions
+
+func (s *FileStore) tmpDir() string {
+	return filepath.Join(s.dir, "tmp")
+}
+
+func (s *FileStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+func validKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// fileWriter hashes an upload while writing it to a temporary file
+type fileWriter struct {
+	store *FileStore
+	file  *os.File
+	hash  hash.Hash
+	size  int64
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *fileWriter) Commit() (string, int64, error) {
+	defer os.Remove(w.file.Name())
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return "", 0, fmt.Errorf("failed to flush blob: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return "", 0, fmt.Errorf("failed to close blob: %w", err)
+	}
+
+	key := hex.EncodeToString(w.hash.Sum(nil))
+	path, _ := w.store.path(key)
+
+	// Identical content is already stored under the same key
+	if _, err := os.Stat(path); err == nil {
+		return key, w.size, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", 0, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := os.Rename(w.file.Name(), path); err != nil {
+		return "", 0, fmt.Errorf("failed to store blob: %w", err)
+	}
+	return key, w.size, nil
+}
+
+func (w *fileWriter) Abort() error {
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+type fileBlob struct {
+	*os.File
+	size int64
+}
+
+func (b *fileBlob) Size() int64 {
+	return b.size
+}
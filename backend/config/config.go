@@ -0,0 +1,360 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FileName = "yana.json"
+
+	DefaultListenAddress = "127.0.0.1"
+	DefaultPort          = 8090
+	DefaultDatabaseFile  = "yana-db.sqlite"
+	DefaultAttachmentDir = "attachments"
+	DefaultThumbnailDir  = "thumbnails"
+	DefaultPortFile      = "yana.port"
+	DefaultBackupDir     = "backups"
+
+	DefaultMaxFileSize    = 100 << 20
+	DefaultMaxRequestSize = 256 << 20
+
+	DefaultTrashRetentionDays = 30
+
+	DefaultBackupDaily   = 7
+	DefaultBackupWeekly  = 4
+	DefaultBackupMonthly = 6
+)
+
+// DefaultAllowedTypes are the content types uploads may have unless configured
+// otherwise; "image/*" stands for every image type
+var DefaultAllowedTypes = []string{
+	"image/*",
+	"video/*",
+	"audio/*",
+	"text/plain",
+	"text/markdown",
+	"text/csv",
+	"application/pdf",
+	"application/json",
+	"application/zip",
+	"application/epub+zip",
+	"application/msword",
+	"application/vnd.ms-excel",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.openxmlformats-officedocument.*",
+	"application/vnd.oasis.opendocument.*",
+}
+
+// Config holds the backend settings. Each value is taken from, in increasing order
+// of precedence: the defaults, the config file in the data directory, YANA_*
+// environment variables and command line flags.
+type Config struct {
+	DataDir       string `json:"-"`
+	ConfigFile    string `json:"-"`
+	Secret        string `json:"-"`
+	ListenAddress string `json:"listenAddress"`
+	// Port 0 picks a free port
+	Port int `json:"port"`
+	// AutoPort falls back to a free port when Port is taken
+	AutoPort bool `json:"autoPort"`
+	// Relative paths are resolved against the data directory
+	DatabaseFile  string `json:"databaseFile"`
+	AttachmentDir string `json:"attachmentDir"`
+	ThumbnailDir  string `json:"thumbnailDir"`
+	PortFile      string `json:"portFile"`
+	// Upload limits in bytes, 0 disables a limit
+	MaxFileSize    int64 `json:"maxFileSize"`
+	MaxRequestSize int64 `json:"maxRequestSize"`
+	// UserQuota bounds the total size of a user's attachments and profile picture
+	UserQuota int64 `json:"userQuota"`
+	// AllowedTypes are the content types uploads may have, "*/*" allows any
+	AllowedTypes []string `json:"allowedTypes"`
+	// TrashRetentionDays is how long deleted notes can be restored, 0 keeps them
+	// until the trash is emptied
+	TrashRetentionDays int `json:"trashRetentionDays"`
+	// BackupDir holds the snapshots of the data directory
+	BackupDir string `json:"backupDir"`
+	// How many scheduled snapshots of each kind are kept, 0 takes none of that kind
+	BackupDaily   int `json:"backupDaily"`
+	BackupWeekly  int `json:"backupWeekly"`
+	BackupMonthly int `json:"backupMonthly"`
+}
+
+// option describes a setting that can come from the environment and the command line
+type option struct {
+	flag  string
+	env   string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+var options = []option{
+	{"listen-address", "YANA_LISTEN_ADDRESS", "address to listen on", func(cfg *Config, v string) error {
+		cfg.ListenAddress = v
+		return nil
+	}},
+	{"port", "YANA_PORT", "port to listen on, 0 picks a free one", func(cfg *Config, v string) (err error) {
+		cfg.Port, err = strconv.Atoi(v)
+		return err
+	}},
+	{"auto-port", "YANA_AUTO_PORT", "pick a free port when the configured one is taken", func(cfg *Config, v string) (err error) {
+		cfg.AutoPort, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"database-file", "YANA_DATABASE_FILE", "SQLite database file", func(cfg *Config, v string) error {
+		cfg.DatabaseFile = v
+		return nil
+	}},
+	{"attachment-dir", "YANA_ATTACHMENT_DIR", "directory for attachment files", func(cfg *Config, v string) error {
+		cfg.AttachmentDir = v
+		return nil
+	}},
+	{"thumbnail-dir", "YANA_THUMBNAIL_DIR", "directory for cached thumbnails", func(cfg *Config, v string) error {
+		cfg.ThumbnailDir = v
+		return nil
+	}},
+	{"port-file", "YANA_PORT_FILE", "file the chosen port is written to, empty to disable", func(cfg *Config, v string) error {
+		cfg.PortFile = v
+		return nil
+	}},
+	{"max-file-size", "YANA_MAX_FILE_SIZE", "largest uploaded file, in bytes or with a K, M or G suffix, 0 for no limit", func(cfg *Config, v string) (err error) {
+		cfg.MaxFileSize, err = parseSize(v)
+		return err
+	}},
+	{"max-request-size", "YANA_MAX_REQUEST_SIZE", "largest request body, in bytes or with a K, M or G suffix, 0 for no limit", func(cfg *Config, v string) (err error) {
+		cfg.MaxRequestSize, err = parseSize(v)
+		return err
+	}},
+	{"user-quota", "YANA_USER_QUOTA", "storage each user may fill, in bytes or with a K, M or G suffix, 0 for no limit", func(cfg *Config, v string) (err error) {
+		cfg.UserQuota, err = parseSize(v)
+		return err
+	}},
+	{"allowed-types", "YANA_ALLOWED_TYPES", "comma separated content types uploads may have, like image/* or */*", func(cfg *Config, v string) error {
+		cfg.AllowedTypes = splitList(v)
+		return nil
+	}},
+	{"trash-retention-days", "YANA_TRASH_RETENTION_DAYS", "days deleted notes stay in the trash, 0 to keep them", func(cfg *Config, v string) (err error) {
+		cfg.TrashRetentionDays, err = strconv.Atoi(v)
+		return err
+	}},
+	{"backup-dir", "YANA_BACKUP_DIR", "directory for snapshots of the data directory", func(cfg *Config, v string) error {
+		cfg.BackupDir = v
+		return nil
+	}},
+	{"backup-daily", "YANA_BACKUP_DAILY", "daily snapshots to keep, 0 to take none", func(cfg *Config, v string) (err error) {
+		cfg.BackupDaily, err = strconv.Atoi(v)
+		return err
+	}},
+	{"backup-weekly", "YANA_BACKUP_WEEKLY", "weekly snapshots to keep, 0 to take none", func(cfg *Config, v string) (err error) {
+		cfg.BackupWeekly, err = strconv.Atoi(v)
+		return err
+	}},
+	{"backup-monthly", "YANA_BACKUP_MONTHLY", "monthly snapshots to keep, 0 to take none", func(cfg *Config, v string) (err error) {
+		cfg.BackupMonthly, err = strconv.Atoi(v)
+		return err
+	}},
+	{"secret", "YANA_BACK_SECRET", "per-launch secret clients must send", func(cfg *Config, v string) error {
+		cfg.Secret = v
+		return nil
+	}},
+}
+
+// Default returns the built-in settings
+func Default() Config {
+	return Config{
+		ListenAddress:  DefaultListenAddress,
+		Port:           DefaultPort,
+		AutoPort:       true,
+		DatabaseFile:   DefaultDatabaseFile,
+		AttachmentDir:  DefaultAttachmentDir,
+		ThumbnailDir:   DefaultThumbnailDir,
+		PortFile:       DefaultPortFile,
+		MaxFileSize:    DefaultMaxFileSize,
+		MaxRequestSize: DefaultMaxRequestSize,
+		AllowedTypes:   DefaultAllowedTypes,
+
+		TrashRetentionDays: DefaultTrashRetentionDays,
+
+		BackupDir:     DefaultBackupDir,
+		BackupDaily:   DefaultBackupDaily,
+		BackupWeekly:  DefaultBackupWeekly,
+		BackupMonthly: DefaultBackupMonthly,
+	}
+}
+
+// Load builds the configuration from command line arguments (without the program
+// name), the environment and the config file. The data directory is given as the
+// first positional argument, -data-dir or YANA_DATA_DIR.
+func Load(args []string) (Config, error) {
+	fs := flag.NewFlagSet("yana-back", flag.ContinueOnError)
+	dataDir := fs.String("data-dir", "", "data directory ($YANA_DATA_DIR)")
+	configFile := fs.String("config", "", "config file, defaults to "+FileName+" in the data directory ($YANA_CONFIG)")
+
+	flagValues := make([]*string, len(options))
+	for i, opt := range options {
+		flagValues[i] = fs.String(opt.flag, "", opt.usage+" ($"+opt.env+")")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+
+	cfg.DataDir = firstNonEmpty(*dataDir, fs.Arg(0), os.Getenv("YANA_DATA_DIR"))
+	if cfg.DataDir == "" {
+		return Config{}, errors.New("no data directory provided")
+	}
+
+	cfg.ConfigFile = firstNonEmpty(*configFile, os.Getenv("YANA_CONFIG"), filepath.Join(cfg.DataDir, FileName))
+	if err := cfg.loadFile(); err != nil {
+		return Config{}, err
+	}
+
+	// Environment first, then flags, so flags win
+	for _, opt := range options {
+		if value, ok := os.LookupEnv(opt.env); ok {
+			if err := opt.set(&cfg, value); err != nil {
+				return Config{}, fmt.Errorf("invalid $%s: %w", opt.env, err)
+			}
+		}
+	}
+
+	passed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+	for i, opt := range options {
+		if passed[opt.flag] {
+			if err := opt.set(&cfg, *flagValues[i]); err != nil {
+				return Config{}, fmt.Errorf("invalid -%s: %w", opt.flag, err)
+			}
+		}
+	}
+
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return Config{}, fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	if cfg.MaxFileSize < 0 || cfg.MaxRequestSize < 0 || cfg.UserQuota < 0 {
+		return Config{}, errors.New("upload limits cannot be negative")
+	}
+	if cfg.TrashRetentionDays < 0 {
+		return Config{}, fmt.Errorf("invalid trash retention %d", cfg.TrashRetentionDays)
+	}
+	if cfg.BackupDaily < 0 || cfg.BackupWeekly < 0 || cfg.BackupMonthly < 0 {
+		return Config{}, errors.New("backup retention cannot be negative")
+	}
+
+	return cfg, nil
+}
+
+// DatabasePath is the absolute or data directory relative path of the SQLite file
+func (cfg Config) DatabasePath() string {
+	return cfg.resolve(cfg.DatabaseFile)
+}
+
+// AttachmentPath is the directory attachment files are stored in
+func (cfg Config) AttachmentPath() string {
+	return cfg.resolve(cfg.AttachmentDir)
+}
+
+// ThumbnailPath is the directory rendered thumbnails are cached in
+func (cfg Config) ThumbnailPath() string {
+	return cfg.resolve(cfg.ThumbnailDir)
+}
+
+// BackupPath is the directory snapshots are kept in
+func (cfg Config) BackupPath() string {
+	return cfg.resolve(cfg.BackupDir)
+}
+
+// TrashRetention is how long deleted notes stay in the trash, 0 for ever
+func (cfg Config) TrashRetention() time.Duration {
+	return time.Duration(cfg.TrashRetentionDays) * 24 * time.Hour
+}
+
+// PortFilePath is where the chosen port is reported, empty to disable
+func (cfg Config) PortFilePath() string {
+	if cfg.PortFile == "" {
+		return ""
+	}
+	return cfg.resolve(cfg.PortFile)
+}
+
+// Helper functions
+
+func (cfg *Config) loadFile() error {
+	raw, err := os.ReadFile(cfg.ConfigFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", cfg.ConfigFile, err)
+	}
+	return nil
+}
+
+func (cfg Config) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cfg.DataDir, path)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseSize reads a byte count with an optional binary K, M or G suffix
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	shift := 0
+	switch {
+	case strings.HasSuffix(value, "K"):
+		shift = 10
+	case strings.HasSuffix(value, "M"):
+		shift = 20
+	case strings.HasSuffix(value, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %s out of range", value)
+	}
+	return n << shift, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,278 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Streams are split into chunks that are sealed separately, so large files can be
+// encrypted and decrypted without holding them in memory and read from any offset.
+// Layout: magic, nonce prefix, then chunks of at most StreamChunkSize plaintext bytes
+// plus a tag. Each chunk's nonce is the prefix followed by the chunk index, and the
+// last chunk is sealed with different additional data so truncation is detected.
+const (
+	StreamChunkSize = 64 * 1024
+
+	streamMagic       = "YCS1"
+	streamPrefixSize  = chacha20poly1305.NonceSizeX - 8
+	streamHeaderSize  = len(streamMagic) + streamPrefixSize
+	streamSealedChunk = StreamChunkSize + chacha20poly1305.Overhead
+)
+
+var (
+	ErrNotStream      = errors.New("data is not an encrypted stream")
+	ErrStreamCorrupt  = errors.New("encrypted stream is truncated or corrupt")
+	errWriterIsClosed = errors.New("stream writer is closed")
+
+	streamMiddleChunk = []byte{0}
+	streamLastChunk   = []byte{1}
+)
+
+// SizedReader is a seekable, random access reader of known size, like *io.SectionReader
+type SizedReader interface {
+	io.ReadSeeker
+	io.ReaderAt
+	Size() int64
+}
+
+// streamWriter seals everything written to it as a stream
+type streamWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+// NewWriter returns a writer that encrypts a stream to w. Close must be called to
+// write the final chunk; it does not close w.
+func NewWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	prefix, err := RandomBytes(streamPrefixSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, streamMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, StreamChunkSize),
+	}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errWriterIsClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only flushed once more data arrives, the last chunk must be
+		// sealed as such on Close
+		if len(s.buf) == StreamChunkSize {
+			if err := s.flush(streamMiddleChunk); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.buf[len(s.buf):StreamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(streamLastChunk)
+}
+
+func (s *streamWriter) flush(additionalData []byte) error {
+	sealed := s.aead.Seal(nil, streamNonce(s.prefix, s.index), s.buf, additionalData)
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+
+	s.index++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// Reader decrypts a stream written by NewWriter
+type Reader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	prefix []byte
+	chunks int64
+	size   int64
+	offset int64
+
+	// The last decrypted chunk, sequential reads mostly hit it
+	mu          sync.Mutex
+	cachedIndex int64
+	cached      []byte
+}
+
+// NewReader opens the stream stored in the first size bytes of r
+func NewReader(key []byte, r io.ReaderAt, size int64) (*Reader, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	header := make([]byte, streamHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotStream
+		}
+		return nil, err
+	}
+	if !IsStream(header) {
+		return nil, ErrNotStream
+	}
+
+	body := size - int64(streamHeaderSize)
+	chunks := (body + streamSealedChunk - 1) / streamSealedChunk
+	lastChunk := body - (chunks-1)*streamSealedChunk
+	if chunks == 0 || lastChunk < chacha20poly1305.Overhead {
+		return nil, ErrStreamCorrupt
+	}
+
+	reader := &Reader{
+		r:           r,
+		aead:        aead,
+		prefix:      header[len(streamMagic):],
+		chunks:      chunks,
+		size:        body - chunks*chacha20poly1305.Overhead,
+		cachedIndex: -1,
+	}
+
+	// Reads never reach the chunk of an empty stream, authenticate it here
+	if reader.size == 0 {
+		if _, err := reader.chunk(0); err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// IsStream reports whether data starts with a stream header
+func IsStream(data []byte) bool {
+	return len(data) >= len(streamMagic) && string(data[:len(streamMagic)]) == streamMagic
+}
+
+// Size is the length of the decrypted stream
+func (s *Reader) Size() int64 {
+	return s.size
+}
+
+func (s *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	read := 0
+	for read < len(p) {
+		if off >= s.size {
+			return read, io.EOF
+		}
+
+		chunk, err := s.chunk(off / StreamChunkSize)
+		if err != nil {
+			return read, err
+		}
+
+		n := copy(p[read:], chunk[off%StreamChunkSize:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+func (s *Reader) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+// chunk returns the decrypted chunk at index
+func (s *Reader) chunk(index int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index == s.cachedIndex {
+		return s.cached, nil
+	}
+
+	sealedSize := int64(streamSealedChunk)
+	additionalData := streamMiddleChunk
+	if index == s.chunks-1 {
+		sealedSize = s.size - index*StreamChunkSize + chacha20poly1305.Overhead
+		additionalData = streamLastChunk
+	}
+
+	sealed := make([]byte, sealedSize)
+	if _, err := s.r.ReadAt(sealed, int64(streamHeaderSize)+index*streamSealedChunk); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	chunk, err := s.aead.Open(sealed[:0], streamNonce(s.prefix, uint64(index)), sealed, additionalData)
+	if err != nil {
+		return nil, ErrStreamCorrupt
+	}
+
+	s.cachedIndex = index
+	s.cached = chunk
+	return chunk, nil
+}
+
+func streamNonce(prefix []byte, index uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[streamPrefixSize:], index)
+	return nonce
+}
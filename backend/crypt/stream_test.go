@@ -0,0 +1,153 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	sizes := []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 100}
+
+	for _, size := range sizes {
+		plaintext := testPlaintext(t, size)
+		sealed := sealStream(t, key, plaintext)
+
+		reader, err := NewReader(key, bytes.NewReader(sealed), int64(len(sealed)))
+		if err != nil {
+			t.Fatalf("size %d: NewReader: %v", size, err)
+		}
+		if reader.Size() != int64(size) {
+			t.Errorf("size %d: Size() = %d", size, reader.Size())
+		}
+
+		got, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("size %d: read: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: decrypted stream differs from the plaintext", size)
+		}
+	}
+}
+
+func TestStreamReadAt(t *testing.T) {
+	key := testKey(t)
+	plaintext := testPlaintext(t, 2*StreamChunkSize+10)
+	sealed := sealStream(t, key, plaintext)
+
+	reader, err := NewReader(key, bytes.NewReader(sealed), int64(len(sealed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A read spanning the boundary of the first two chunks
+	got := make([]byte, 20)
+	if _, err := reader.ReadAt(got, StreamChunkSize-10); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext[StreamChunkSize-10:StreamChunkSize+10]) {
+		t.Error("ReadAt across chunks returned the wrong bytes")
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := testKey(t)
+	sealed := sealStream(t, key, testPlaintext(t, 2*StreamChunkSize+10))
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"final chunk dropped", streamHeaderSize + 2*streamSealedChunk},
+		{"final chunk cut short", len(sealed) - 1},
+		{"header only", streamHeaderSize},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := readStream(key, sealed[:test.size]); !errors.Is(err, ErrStreamCorrupt) {
+				t.Errorf("got %v, want ErrStreamCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestStreamReorderedChunks(t *testing.T) {
+	key := testKey(t)
+	sealed := sealStream(t, key, testPlaintext(t, 2*StreamChunkSize+10))
+
+	first := sealed[streamHeaderSize : streamHeaderSize+streamSealedChunk]
+	second := sealed[streamHeaderSize+streamSealedChunk : streamHeaderSize+2*streamSealedChunk]
+	swapped := append(append(append([]byte{}, sealed[:streamHeaderSize]...), second...), first...)
+	swapped = append(swapped, sealed[streamHeaderSize+2*streamSealedChunk:]...)
+
+	if err := readStream(key, swapped); !errors.Is(err, ErrStreamCorrupt) {
+		t.Errorf("got %v, want ErrStreamCorrupt", err)
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	for _, size := range []int{0, 100} {
+		sealed := sealStream(t, testKey(t), testPlaintext(t, size))
+		if err := readStream(testKey(t), sealed); !errors.Is(err, ErrStreamCorrupt) {
+			t.Errorf("size %d: got %v, want ErrStreamCorrupt", size, err)
+		}
+	}
+}
+
+func TestStreamNotStream(t *testing.T) {
+	data := []byte("plain attachment content")
+	if _, err := NewReader(testKey(t), bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrNotStream) {
+		t.Errorf("got %v, want ErrNotStream", err)
+	}
+}
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := RandomBytes(KeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testPlaintext(t *testing.T, size int) []byte {
+	t.Helper()
+	plaintext, err := RandomBytes(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plaintext
+}
+
+// sealStream encrypts plaintext in uneven writes, so chunks do not line up with them
+func sealStream(t *testing.T, key, plaintext []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := NewWriter(key, &sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := plaintext; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func readStream(key, sealed []byte) error {
+	reader, err := NewReader(key, bytes.NewReader(sealed), int64(len(sealed)))
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadAll(reader)
+	return err
+}
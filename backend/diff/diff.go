@@ -0,0 +1,110 @@
+package diff
+
+import (
+	"strings"
+)
+
+// Op tells what happened to a line between the old and the new text
+type Op string
+
+const (
+	Equal  Op = "equal"
+	Delete Op = "delete"
+	Insert Op = "insert"
+)
+
+// MaxCells bounds the size of the table the longest common subsequence is computed
+// in; beyond it the changed middle part is reported as replaced as a whole
+const MaxCells = 4_000_000
+
+// Line is a line of the diff
+type Line struct {
+	Op   Op     `json:"op"`
+	Text string `json:"text"`
+}
+
+// Lines diffs two texts line by line, keeping the longest common subsequence of
+// lines and reporting the others as deleted from a or inserted from b
+func Lines(a, b string) []Line {
+	return Slices(splitLines(a), splitLines(b))
+}
+
+// Slices diffs two lists of lines, see Lines
+func Slices(a, b []string) []Line {
+	// Lines shared at both ends need no table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	lines := make([]Line, 0, len(a)+len(b)-prefix-suffix)
+	lines = appendLines(lines, Equal, a[:prefix])
+	lines = append(lines, middle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	lines = appendLines(lines, Equal, a[len(a)-suffix:])
+	return lines
+}
+
+// Helper functions
+
+// middle diffs the parts of a and b between their common ends
+func middle(a, b []string) []Line {
+	if len(a) == 0 || len(b) == 0 || (len(a)+1)*(len(b)+1) > MaxCells {
+		lines := appendLines(nil, Delete, a)
+		return appendLines(lines, Insert, b)
+	}
+
+	// lengths[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	width := len(b) + 1
+	lengths := make([]int32, (len(a)+1)*width)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i*width+j] = lengths[(i+1)*width+j+1] + 1
+			case lengths[(i+1)*width+j] >= lengths[i*width+j+1]:
+				lengths[i*width+j] = lengths[(i+1)*width+j]
+			default:
+				lengths[i*width+j] = lengths[i*width+j+1]
+			}
+		}
+	}
+
+	var lines []Line
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, Line{Equal, a[i]})
+			i++
+			j++
+		case lengths[(i+1)*width+j] >= lengths[i*width+j+1]:
+			lines = append(lines, Line{Delete, a[i]})
+			i++
+		default:
+			lines = append(lines, Line{Insert, b[j]})
+			j++
+		}
+	}
+	lines = appendLines(lines, Delete, a[i:])
+	return appendLines(lines, Insert, b[j:])
+}
+
+func appendLines(lines []Line, op Op, texts []string) []Line {
+	for _, text := range texts {
+		lines = append(lines, Line{op, text})
+	}
+	return lines
+}
+
+// splitLines splits text at line breaks; an empty text has no lines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
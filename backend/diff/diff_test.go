@@ -0,0 +1,87 @@
+package diff
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Line
+	}{
+		{"both empty", "", "", []Line{}},
+		{"from empty", "", "one\ntwo", []Line{{Insert, "one"}, {Insert, "two"}}},
+		{"to empty", "one\ntwo\n", "", []Line{{Delete, "one"}, {Delete, "two"}}},
+		{"unchanged", "one\ntwo", "one\r\ntwo\n", []Line{{Equal, "one"}, {Equal, "two"}}},
+		{
+			"insert",
+			"one\nthree", "one\ntwo\nthree",
+			[]Line{{Equal, "one"}, {Insert, "two"}, {Equal, "three"}},
+		},
+		{
+			"delete",
+			"one\ntwo\nthree", "one\nthree",
+			[]Line{{Equal, "one"}, {Delete, "two"}, {Equal, "three"}},
+		},
+		{
+			"replace",
+			"one\ntwo\nthree", "one\n2\nthree",
+			[]Line{{Equal, "one"}, {Delete, "two"}, {Insert, "2"}, {Equal, "three"}},
+		},
+		{
+			"keeps common lines in the middle",
+			"a\nx\nb\ny\nc", "a\nb\nz\nc",
+			[]Line{{Equal, "a"}, {Delete, "x"}, {Equal, "b"}, {Delete, "y"}, {Insert, "z"}, {Equal, "c"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Lines(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Lines(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSlicesOverMaxCells(t *testing.T) {
+	// Both sides share a line in the middle, but the table would exceed MaxCells
+	n := 2001
+	a := make([]string, n)
+	b := make([]string, n)
+	for i := range a {
+		a[i] = fmt.Sprintf("a%d", i)
+		b[i] = fmt.Sprintf("b%d", i)
+	}
+	a[n/2], b[n/2] = "shared", "shared"
+	if (n+1)*(n+1) <= MaxCells {
+		t.Fatalf("%d lines fit in MaxCells", n)
+	}
+
+	got := Slices(a, b)
+	if len(got) != 2*n {
+		t.Fatalf("got %d lines, want %d", len(got), 2*n)
+	}
+	for i, line := range got {
+		want := Line{Delete, a[i%n]}
+		if i >= n {
+			want = Line{Insert, b[i-n]}
+		}
+		if line != want {
+			t.Fatalf("line %d = %v, want %v", i, line, want)
+		}
+	}
+}
+
+func TestSlicesUnderMaxCells(t *testing.T) {
+	// The same change in a smaller text keeps the shared line
+	a := []string{"a0", "shared", "a1"}
+	b := []string{"b0", "shared", "b1"}
+	want := []Line{{Delete, "a0"}, {Insert, "b0"}, {Equal, "shared"}, {Delete, "a1"}, {Insert, "b1"}}
+	if got := Slices(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Slices(%q, %q) = %v, want %v", a, b, got, want)
+	}
+}
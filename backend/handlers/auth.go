@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	SessionTTL        = 7 * 24 * time.Hour
+	SessionContextKey = "session_user_id"
+	SessionQueryParam = "token"
+)
+
+// publicRoutes are reachable without a session token
+var publicRoutes = map[string]bool{
+	"/health":                true,
+	"/login":                 true,
+	"/signup":                true,
+	"/user/password/recover": true,
+	"/vault/unlock":          true,
+}
+
+// sessionSecret signs session tokens; it is regenerated on every launch
+var sessionSecret = mustRandomBytes(32)
+
+// sessionClaims is the signed payload carried by a session token
+type sessionClaims struct {
+	UserID uint `json:"uid"`
+	// Epoch is the user's session epoch when the token was issued
+	Epoch     int   `json:"epoch"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// LoginHandler verifies a user's password and returns a signed session token
+func LoginHandler(c echo.Context) error {
+	userID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var user models.User
+	if err := DB.First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch user"})
+	}
+
+	release, err := checkThrottle(c, ThrottleScopeUser, user.ID, user.Hint)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !checkPassword(user.Password, c.FormValue("password")) {
+		recordFailedAttempt(c, ThrottleScopeUser, user.ID)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+	}
+	recordSuccessfulAttempt(c, ThrottleScopeUser, user.ID)
+
+	return respondWithSession(c, user, nil)
+}
+
+// SignupHandler creates a new user from a form or JSON body and logs them in
+func SignupHandler(c echo.Context) error {
+	input, err := bindUserInput(c)
+	if err != nil {
+		return err
+	}
+
+	var user models.User
+	updateUserFields(&user, input)
+
+	var batch blobBatch
+	defer batch.finish()
+
+	if err := handleProfilePicture(&user, &batch, c); err != nil {
+		return err
+	}
+
+	// A password chosen at signup comes with its recovery codes, all saved with the
+	// user or not at all
+	var password *newPassword
+	if value := stringValue(input.Password); value != "" {
+		prepared, err := prepareNewPassword(value)
+		if err != nil {
+			log.Printf("Failed to set password: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set password"})
+		}
+		password = &prepared
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		if password != nil {
+			if err := password.save(tx, &user); err != nil {
+				return err
+			}
+		}
+		return batch.commit(tx)
+	})
+	if err != nil {
+		log.Printf("Failed to save user: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save user"})
+	}
+
+	var recoveryCodes []string
+	if password != nil {
+		recoveryCodes = password.codes
+	}
+	return respondWithSession(c, user, recoveryCodes)
+}
+
+// RequireSession rejects requests to non-public routes that lack a valid session token
+func RequireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if publicRoutes[c.Path()] {
+			return next(c)
+		}
+
+		claims, err := parseSessionToken(sessionTokenFromRequest(c))
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Authentication required"})
+		}
+
+		// Sessions end when the user's password changes
+		current, err := isCurrentSession(claims)
+		if err != nil {
+			log.Printf("Failed to check session: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check session"})
+		}
+		if !current {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Authentication required"})
+		}
+
+		c.Set(SessionContextKey, claims.UserID)
+		return next(c)
+	}
+}
+
+// Helper functions
+
+// respondWithSession logs the user in; freshly generated recovery codes are included
+// so the client can show them once
+func respondWithSession(c echo.Context, user models.User, recoveryCodes []string) error {
+	response, err := sessionResponse(user)
+	if err != nil {
+		log.Printf("Failed to issue session token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create session"})
+	}
+
+	if recoveryCodes != nil {
+		response["recoveryCodes"] = recoveryCodes
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// sessionResponse issues a session token for the user and returns the response fields
+// that carry it
+func sessionResponse(user models.User) (map[string]interface{}, error) {
+	token, expiresAt, err := issueSessionToken(user.ID, user.SessionEpoch)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"token":     token,
+		"expiresAt": expiresAt,
+		"user":      user,
+	}, nil
+}
+
+// endSessions counts up the user's session epoch in tx, which ends every session
+// issued before
+func endSessions(tx *gorm.DB, user *models.User) error {
+	if err := tx.Model(user).UpdateColumn("session_epoch", gorm.Expr("session_epoch + 1")).Error; err != nil {
+		return err
+	}
+	user.SessionEpoch++
+	return nil
+}
+
+// isCurrentSession tells whether the session was issued since the user's sessions
+// last ended
+func isCurrentSession(claims sessionClaims) (bool, error) {
+	var epochs []int
+	if err := DB.Model(&models.User{}).Where("id = ?", claims.UserID).Pluck("session_epoch", &epochs).Error; err != nil {
+		return false, err
+	}
+	return len(epochs) > 0 && epochs[0] == claims.Epoch, nil
+}
+
+func sessionTokenFromRequest(c echo.Context) string {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	// Fallback for resources loaded by the browser directly, e.g. <img src>
+	return c.QueryParam(SessionQueryParam)
+}
+
+func issueSessionToken(userID uint, epoch int) (string, time.Time, error) {
+	expiresAt := time.Now().Add(SessionTTL)
+	payload, err := json.Marshal(sessionClaims{UserID: userID, Epoch: epoch, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signSession(encoded), expiresAt, nil
+}
+
+func parseSessionToken(token string) (sessionClaims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signSession(encoded))) {
+		return sessionClaims{}, errors.New("invalid session token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return sessionClaims{}, fmt.Errorf("invalid session payload: %w", err)
+	}
+
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return sessionClaims{}, fmt.Errorf("invalid session payload: %w", err)
+	}
+
+	if time.Now().Unix() > claims.ExpiresAt {
+		return sessionClaims{}, errors.New("session expired")
+	}
+
+	return claims, nil
+}
+
+func signSession(encoded string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func sessionUserID(c echo.Context) uint {
+	userID, _ := c.Get(SessionContextKey).(uint)
+	return userID
+}
+
+func mustRandomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate random bytes: %v", err)
+	}
+	return b
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	token, expiresAt, err := issueSessionToken(42, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expiresAt) <= SessionTTL-time.Minute {
+		t.Errorf("token expires at %v, want in %v", expiresAt, SessionTTL)
+	}
+
+	claims, err := parseSessionToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 42 || claims.Epoch != 3 {
+		t.Errorf("token is for user %d in epoch %d, want 42 in 3", claims.UserID, claims.Epoch)
+	}
+}
+
+func TestSessionTokenRejectsInvalidTokens(t *testing.T) {
+	token, _, err := issueSessionToken(42, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, signature, _ := strings.Cut(token, ".")
+
+	// Another user's claims under the original signature
+	forged, err := json.Marshal(sessionClaims{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"unsigned", encoded},
+		{"bad signature", encoded + "." + signature[1:]},
+		{"forged claims", base64.RawURLEncoding.EncodeToString(forged) + "." + signature},
+		{"expired", signedClaims(t, sessionClaims{UserID: 42, ExpiresAt: time.Now().Add(-time.Minute).Unix()})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if claims, err := parseSessionToken(test.token); err == nil {
+				t.Errorf("accepted a session for user %d", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestSignupWithPassword(t *testing.T) {
+	setupTestDB(t)
+	e := echo.New()
+	e.POST("/signup", SignupHandler)
+
+	rec := postForm(e, "/signup", url.Values{"name": {"Ada"}, "password": {"secret"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	var response struct {
+		Token         string      `json:"token"`
+		User          models.User `json:"user"`
+		RecoveryCodes []string    `json:"recoveryCodes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Token == "" || !response.User.HasPassword || len(response.RecoveryCodes) != RecoveryCodeCount {
+		t.Errorf("signup returned %+v, want a session, a password and recovery codes", response)
+	}
+
+	var codes int64
+	if err := DB.Model(&models.RecoveryCode{}).Where("user_id = ?", response.User.ID).Count(&codes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if codes != RecoveryCodeCount {
+		t.Errorf("stored %d recovery codes, want %d", codes, RecoveryCodeCount)
+	}
+}
+
+func TestSignupSavesNothingOnFailure(t *testing.T) {
+	setupTestDB(t)
+	e := echo.New()
+	e.POST("/signup", SignupHandler)
+
+	// Saving the recovery codes fails after the user is inserted
+	if err := DB.Migrator().DropTable(&models.RecoveryCode{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postForm(e, "/signup", url.Values{"name": {"Ada"}, "password": {"secret"}})
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want 500", rec.Code)
+	}
+
+	var users int64
+	if err := DB.Model(&models.User{}).Count(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if users != 0 {
+		t.Errorf("%d users saved without their password", users)
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "")
+
+	ended, _, err := issueSessionToken(user.ID, user.SessionEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := endSessions(DB, &user); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := issueSessionToken(user.ID, user.SessionEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownUser, _, err := issueSessionToken(user.ID+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(RequireSession)
+	e.GET("/health", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.GET("/notes", func(c echo.Context) error {
+		if userID := sessionUserID(c); userID != user.ID {
+			t.Errorf("session user is %d, want %d", userID, user.ID)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   int
+	}{
+		{"public route", "/health", "", http.StatusOK},
+		{"no token", "/notes", "", http.StatusUnauthorized},
+		{"bearer token", "/notes", "Bearer " + token, http.StatusOK},
+		{"query token", "/notes?" + SessionQueryParam + "=" + token, "", http.StatusOK},
+		{"invalid token", "/notes", "Bearer " + token + "x", http.StatusUnauthorized},
+		{"ended session", "/notes", "Bearer " + ended, http.StatusUnauthorized},
+		{"unknown user", "/notes", "Bearer " + unknownUser, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.header != "" {
+				req.Header.Set(echo.HeaderAuthorization, test.header)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != test.want {
+				t.Errorf("got status %d, want %d", rec.Code, test.want)
+			}
+		})
+	}
+}
+
+// signedClaims signs arbitrary claims the way issueSessionToken does
+func signedClaims(t *testing.T, claims sessionClaims) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signSession(encoded)
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"yana-back/backup"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Backups takes the snapshots of the data directory
+var Backups *backup.Manager
+
+// CreateBackupHandler takes a snapshot of the database and blob store while the
+// backend keeps serving requests
+func CreateBackupHandler(c echo.Context) error {
+	snapshot, err := Backups.Create(c.Request().Context(), backup.Manual)
+	if err != nil {
+		log.Printf("Failed to take snapshot: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to take snapshot"})
+	}
+
+	return c.JSON(http.StatusCreated, buildSnapshotResponse(snapshot))
+}
+
+// GetBackupsHandler lists the snapshots, newest first
+func GetBackupsHandler(c echo.Context) error {
+	snapshots, err := Backups.List()
+	if err != nil {
+		log.Printf("Failed to list snapshots: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list snapshots"})
+	}
+
+	responses := make([]map[string]interface{}, len(snapshots))
+	for i, snapshot := range snapshots {
+		responses[i] = buildSnapshotResponse(snapshot)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"snapshots": responses})
+}
+
+// Helper functions
+
+// buildSnapshotResponse leaves out where snapshots are stored on disk
+func buildSnapshotResponse(snapshot backup.Snapshot) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      snapshot.Name,
+		"kind":      snapshot.Kind,
+		"createdAt": snapshot.CreatedAt,
+		"size":      snapshot.Size(),
+	}
+}
@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
@@ -12,15 +14,112 @@ import (
 // Global variable for the GORM DB connection
 var DB *gorm.DB
 
-// ExitServerHandler gracefully shuts down the server
+// shutdownRequests carries shutdown requests from the API to main
+var shutdownRequests = make(chan struct{}, 1)
+
+// HealthHandler reports that the backend is up and whether the vault is locked
+func HealthHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{
+		"status": "ok",
+		"vault":  vaultState(),
+	})
+}
+
+// YanaBackDownHandler asks main to gracefully shut down the server
 func YanaBackDownHandler(c echo.Context) error {
-	go func() {
-		log.Println("Shutting down the server...")
-		os.Exit(0)
-	}()
+	log.Println("Shutdown requested")
+	select {
+	case shutdownRequests <- struct{}{}:
+	default: // Already requested
+	}
 
-	// Return a success message immediately
+	// Return a success message immediately, the shutdown waits for this response
 	return c.JSON(http.StatusOK, map[string]string{
 		"message": "Server is shutting down",
 	})
 }
+
+// ShutdownRequested is signalled when a client asks the server to shut down
+func ShutdownRequested() <-chan struct{} {
+	return shutdownRequests
+}
+
+// jsonError builds an error that echo renders as {"error": message} with the given status
+func jsonError(status int, message string) error {
+	return echo.NewHTTPError(status, map[string]string{"error": message})
+}
+
+// ownedBy scopes a query to the records that belong to a single user
+func ownedBy(userID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id = ?", userID)
+	}
+}
+
+// isJSONRequest reports whether the request body is JSON rather than form data
+func isJSONRequest(c echo.Context) bool {
+	return strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+}
+
+// bindJSON decodes a JSON request body; pointer fields stay nil when absent
+func bindJSON(c echo.Context, input interface{}) error {
+	if err := json.NewDecoder(c.Request().Body).Decode(input); err != nil {
+		if sizeErr := requestSizeError(err); sizeErr != nil {
+			return sizeErr
+		}
+		return jsonError(http.StatusBadRequest, "Invalid JSON body")
+	}
+	return nil
+}
+
+// formString returns a form value, nil when the field was not sent at all
+func formString(c echo.Context, name string) *string {
+	params, err := c.FormParams()
+	if err != nil {
+		return nil
+	}
+
+	values, ok := params[name]
+	if !ok || len(values) == 0 {
+		return nil
+	}
+	return &values[0]
+}
+
+// formBool reads a "true"/"false" form value, nil when not sent
+func formBool(c echo.Context, name string) *bool {
+	value := formString(c, name)
+	if value == nil {
+		return nil
+	}
+
+	b := strings.EqualFold(*value, "true")
+	return &b
+}
+
+// formInt reads a numeric form value, nil when not sent or empty
+func formInt(c echo.Context, name string) (*int, error) {
+	value := formString(c, name)
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(*value)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func setIfPresent(field *string, value *string) {
+	if value != nil {
+		*field = *value
+	}
+}
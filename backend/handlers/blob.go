@@ -0,0 +1,743 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"yana-back/blobstore"
+	"yana-back/crypt"
+	"yana-back/models"
+	"yana-back/vault"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Blobs stores the content of attachments and profile pictures; the database only
+// keeps their keys
+var Blobs blobstore.Store
+
+// blobPins keeps blobs whose referencing rows are not committed yet from being
+// deleted as unreferenced
+var blobPins = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// blobBatch tracks the blobs a change refers to and stops referring to. commit counts
+// the references in the change's transaction, finish must be called once the change
+// is committed or rolled back.
+type blobBatch struct {
+	written []models.Blob
+	dropped []string
+	// rewritten maps blobs copied under a new key to their copy
+	rewritten map[string]models.Blob
+}
+
+// write streams r into a blob, encrypted with key if set and with the vault key in
+// vault mode, and returns the blob key and the plaintext size. Without a key,
+// content that is already stored is not stored again.
+func (b *blobBatch) write(r io.Reader, key []byte) (string, int64, error) {
+	var contentHash hash.Hash
+	if key == nil {
+		var err error
+		if contentHash, err = vault.ContentHash(); err != nil {
+			return "", 0, err
+		}
+		r = io.TeeReader(r, contentHash)
+	}
+
+	w, err := Blobs.Create()
+	if err != nil {
+		return "", 0, err
+	}
+
+	size, err := writeBlobLayers(w, r, key)
+	if err != nil {
+		w.Abort()
+		return "", 0, err
+	}
+
+	blob := models.Blob{Size: size}
+	var existing []models.Blob
+	if contentHash != nil {
+		blob.ContentHash = hex.EncodeToString(contentHash.Sum(nil))
+		if err := DB.Where("content_hash = ?", blob.ContentHash).Limit(1).Find(&existing).Error; err != nil {
+			w.Abort()
+			return "", 0, err
+		}
+	}
+
+	// Committing and pinning at once, so the blob cannot be pruned in between. No
+	// database writes happen under the lock, a transaction may be waiting for it.
+	blobPins.Lock()
+	defer blobPins.Unlock()
+
+	if len(existing) > 0 && blobExists(existing[0].Key) {
+		w.Abort()
+		b.pin(existing[0])
+		return existing[0].Key, size, nil
+	}
+
+	blob.Key, blob.StoredSize, err = w.Commit()
+	if err != nil {
+		return "", 0, err
+	}
+
+	b.pin(blob)
+	return blob.Key, size, nil
+}
+
+// rewrite copies a blob under a new key, reading its plaintext from open. A blob
+// shared by several rows is copied once, the rows share the copy again.
+func (b *blobBatch) rewrite(blobKey string, open func() (*blobReader, error), key []byte) (string, int64, error) {
+	if blob, ok := b.rewritten[blobKey]; ok {
+		b.reference(blob)
+		return blob.Key, blob.Size, nil
+	}
+
+	reader, err := open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+
+	newKey, size, err := b.write(reader, key)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if blobKey != "" {
+		if b.rewritten == nil {
+			b.rewritten = make(map[string]models.Blob)
+		}
+		b.rewritten[blobKey] = models.Blob{Key: newKey, Size: size}
+	}
+	return newKey, size, nil
+}
+
+// reference counts one more reference to a stored blob
+func (b *blobBatch) reference(blob models.Blob) {
+	blobPins.Lock()
+	defer blobPins.Unlock()
+	b.pin(blob)
+}
+
+// drop notes blobs the change no longer refers to
+func (b *blobBatch) drop(blobKeys ...string) {
+	for _, blobKey := range blobKeys {
+		if blobKey != "" {
+			b.dropped = append(b.dropped, blobKey)
+		}
+	}
+}
+
+// commit counts a reference to every written blob and releases the dropped ones
+func (b *blobBatch) commit(tx *gorm.DB) error {
+	for _, blob := range b.written {
+		if err := addBlobReferences(tx, blob, 1); err != nil {
+			return err
+		}
+	}
+	for _, blobKey := range b.dropped {
+		if err := releaseBlobReferences(tx, blobKey, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish unpins the written blobs and deletes those of the written and dropped blobs
+// that nothing refers to, which covers uploads of a rolled back change
+func (b *blobBatch) finish() {
+	blobKeys := b.dropped
+	blobPins.Lock()
+	for _, blob := range b.written {
+		if blobPins.counts[blob.Key]--; blobPins.counts[blob.Key] <= 0 {
+			delete(blobPins.counts, blob.Key)
+		}
+		blobKeys = append(blobKeys, blob.Key)
+	}
+	blobPins.Unlock()
+
+	deleteUnreferencedBlobs(blobKeys)
+	b.written, b.dropped, b.rewritten = nil, nil, nil
+}
+
+// pin must be called with blobPins locked
+func (b *blobBatch) pin(blob models.Blob) {
+	blobPins.counts[blob.Key]++
+	b.written = append(b.written, blob)
+}
+
+// blobReader reads the plaintext of a stored blob
+type blobReader struct {
+	crypt.SizedReader
+	blob blobstore.Blob
+}
+
+func (r *blobReader) Close() error {
+	if r.blob == nil {
+		return nil
+	}
+	return r.blob.Close()
+}
+
+// openBlob opens a blob written by blobBatch.write with the same key
+func openBlob(blobKey string, key []byte) (*blobReader, error) {
+	blob, err := Blobs.Open(blobKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := vault.NewReader(blob)
+	if err == nil && key != nil {
+		reader, err = crypt.NewReader(key, reader, reader.Size())
+	}
+	if err != nil {
+		blob.Close()
+		return nil, fmt.Errorf("failed to decrypt blob: %w", err)
+	}
+
+	return &blobReader{SizedReader: reader, blob: blob}, nil
+}
+
+// openDocument returns a reader of an attachment's plaintext, given its note's key
+func openDocument(document models.Document, key []byte) (*blobReader, error) {
+	if document.Encrypted && key == nil {
+		return nil, errors.New("document is encrypted")
+	}
+	if !document.Encrypted {
+		key = nil
+	}
+
+	// Attachments stored before the blob store are still in the database
+	if document.BlobKey == "" {
+		data, err := documentData(document, key)
+		if err != nil {
+			return nil, err
+		}
+		return &blobReader{SizedReader: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))}, nil
+	}
+
+	return openBlob(document.BlobKey, key)
+}
+
+// openProfilePicture returns a reader of a user's profile picture, nil when none is set
+func openProfilePicture(user models.User) (*blobReader, error) {
+	if user.ProfilePictureKey != "" {
+		return openBlob(user.ProfilePictureKey, nil)
+	}
+	if len(user.ProfilePicture) > 0 {
+		data := user.ProfilePicture
+		return &blobReader{SizedReader: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))}, nil
+	}
+	return nil, nil
+}
+
+// CountBlobReferences recounts the references to every blob, registering blobs that
+// were stored before references were counted, and deletes the blobs nothing refers to.
+// It runs before requests are served.
+func CountBlobReferences() error {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Exec(`INSERT OR IGNORE INTO blobs (key, size, created_at)
+			SELECT blob_key, MAX(size), ? FROM documents WHERE blob_key <> '' GROUP BY blob_key`, now).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(`INSERT OR IGNORE INTO blobs (key, size, created_at)
+			SELECT blob_key, MAX(size), ? FROM revision_documents WHERE blob_key <> '' GROUP BY blob_key`, now).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(`INSERT OR IGNORE INTO blobs (key, created_at)
+			SELECT DISTINCT profile_picture_key, ? FROM users WHERE profile_picture_key <> ''`, now).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Exec(`UPDATE blobs SET ref_count =
+			(SELECT COUNT(*) FROM documents WHERE blob_key = blobs.key) +
+			(SELECT COUNT(*) FROM revision_documents WHERE blob_key = blobs.key) +
+			(SELECT COUNT(*) FROM users WHERE profile_picture_key = blobs.key)`).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	var unreferenced []string
+	if err := DB.Model(&models.Blob{}).Where("ref_count = 0").Pluck("key", &unreferenced).Error; err != nil {
+		return err
+	}
+	deleteUnreferencedBlobs(unreferenced)
+	return nil
+}
+
+// DeduplicateBlobs hashes the blobs registered by CountBlobReferences and merges
+// those with the same content. Attachments of locked notes are skipped, their
+// blobs are encrypted under different keys.
+func DeduplicateBlobs(ctx context.Context) error {
+	if !vault.Unlocked() {
+		return nil // Called again once the vault is unlocked
+	}
+
+	var blobKeys []string
+	err := DB.Model(&models.Blob{}).
+		Where("content_hash = '' AND stored_size = 0").
+		Where("key NOT IN (?)", DB.Model(&models.Document{}).Select("blob_key").Where("encrypted = ?", true)).
+		Where("key NOT IN (?)", DB.Model(&models.RevisionDocument{}).Select("blob_key").Where("encrypted = ?", true)).
+		Pluck("key", &blobKeys).Error
+	if err != nil {
+		return err
+	}
+
+	merged := 0
+	for _, blobKey := range blobKeys {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		ok, err := hashBlob(blobKey)
+		if err != nil {
+			return fmt.Errorf("failed to hash blob %s: %w", blobKey, err)
+		}
+		if ok {
+			merged++
+		}
+	}
+
+	if merged > 0 {
+		log.Printf("Merged %d files with identical content", merged)
+	}
+	return nil
+}
+
+// MoveBlobsOutOfDatabase moves attachments and profile pictures stored in the
+// database before the blob store existed into it. Attachments of locked notes are
+// moved when their note is next unlocked, as that needs the note's key.
+func MoveBlobsOutOfDatabase(ctx context.Context) error {
+	if !vault.Unlocked() {
+		return nil // Called again once the vault is unlocked
+	}
+
+	moved := 0
+	for ctx.Err() == nil {
+		var documents []models.Document
+		if err := DB.Where("blob_key = '' AND encrypted = ?", false).Limit(1).Find(&documents).Error; err != nil {
+			return err
+		}
+		if len(documents) == 0 {
+			break
+		}
+
+		if err := moveDocumentBlob(documents[0]); err != nil {
+			return fmt.Errorf("failed to move document %d: %w", documents[0].ID, err)
+		}
+		moved++
+	}
+
+	for ctx.Err() == nil {
+		var users []models.User
+		if err := DB.Where("profile_picture_key = '' AND length(profile_picture) > 0").Limit(1).Find(&users).Error; err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			break
+		}
+
+		if err := moveProfilePictureBlob(users[0]); err != nil {
+			return fmt.Errorf("failed to move profile picture of user %d: %w", users[0].ID, err)
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		log.Printf("Moved %d files from the database to the blob store", moved)
+	}
+	return ctx.Err()
+}
+
+// SealBlobsWithVault re-encrypts the blobs written before vault mode was enabled
+// with the vault key; the note key layer of locked notes' attachments is kept
+func SealBlobsWithVault(ctx context.Context) error {
+	if !vault.Enabled() || !vault.Unlocked() {
+		return nil
+	}
+
+	var documents []models.Document
+	if err := DB.Select("id", "blob_key").Where("blob_key <> ''").Find(&documents).Error; err != nil {
+		return err
+	}
+	for _, document := range documents {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := resealBlob(&models.Document{ID: document.ID}, "blob_key", document.BlobKey); err != nil {
+			return fmt.Errorf("failed to encrypt document %d: %w", document.ID, err)
+		}
+	}
+
+	var revisionDocuments []models.RevisionDocument
+	if err := DB.Select("id", "blob_key").Where("blob_key <> ''").Find(&revisionDocuments).Error; err != nil {
+		return err
+	}
+	for _, document := range revisionDocuments {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := resealBlob(&models.RevisionDocument{ID: document.ID}, "blob_key", document.BlobKey); err != nil {
+			return fmt.Errorf("failed to encrypt revision document %d: %w", document.ID, err)
+		}
+	}
+
+	var users []models.User
+	if err := DB.Select("id", "profile_picture_key").Where("profile_picture_key <> ''").Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := resealBlob(&models.User{ID: user.ID}, "profile_picture_key", user.ProfilePictureKey); err != nil {
+			return fmt.Errorf("failed to encrypt profile picture of user %d: %w", user.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// GetStorageStatsHandler reports the space taken by the user's attachments and profile
+// picture, and how much storing identical contents once saved
+func GetStorageStatsHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var blobKeys []string
+	err = DB.Raw(`SELECT blob_key FROM documents WHERE user_id = ? AND blob_key <> ''
+		UNION ALL SELECT profile_picture_key FROM users WHERE id = ? AND profile_picture_key <> ''`, userID, userID).
+		Scan(&blobKeys).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch storage stats"})
+	}
+
+	var blobs []models.Blob
+	if err := DB.Where("key IN ?", blobKeys).Find(&blobs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch storage stats"})
+	}
+
+	blobsByKey := make(map[string]models.Blob, len(blobs))
+	for _, blob := range blobs {
+		blobsByKey[blob.Key] = blob
+	}
+
+	var size, uniqueSize, storedSize int64
+	for _, blobKey := range blobKeys {
+		size += blobsByKey[blobKey].Size
+	}
+	for _, blob := range blobs {
+		uniqueSize += blob.Size
+		storedSize += blob.StoredSize
+	}
+
+	return c.JSON(http.StatusOK, map[string]int64{
+		"files":      int64(len(blobKeys)),
+		"blobs":      int64(len(blobs)),
+		"size":       size,
+		"storedSize": storedSize,
+		"savedSize":  size - uniqueSize,
+	})
+}
+
+// Helper functions
+
+// writeBlobLayers copies r to w through the note key and vault encryption layers
+func writeBlobLayers(w io.Writer, r io.Reader, key []byte) (int64, error) {
+	vaultWriter, err := vault.NewWriter(w)
+	if err != nil {
+		return 0, err
+	}
+
+	dst := vaultWriter
+	if key != nil {
+		if dst, err = crypt.NewWriter(key, vaultWriter); err != nil {
+			return 0, err
+		}
+	}
+
+	size, err := io.Copy(dst, r)
+	if err != nil {
+		return 0, err
+	}
+
+	if key != nil {
+		if err := dst.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return size, vaultWriter.Close()
+}
+
+func moveDocumentBlob(document models.Document) error {
+	var batch blobBatch
+	defer batch.finish()
+
+	blobKey, size, err := batch.write(bytes.NewReader(document.Data), nil)
+	if err != nil {
+		return err
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		// Only if the attachment was not changed meanwhile; a changed one is picked up again
+		result := tx.Model(&models.Document{}).
+			Where("id = ? AND blob_key = ''", document.ID).
+			Updates(map[string]interface{}{"blob_key": blobKey, "size": size, "data": nil})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return batch.commit(tx)
+	})
+}
+
+func moveProfilePictureBlob(user models.User) error {
+	var batch blobBatch
+	defer batch.finish()
+
+	blobKey, _, err := batch.write(bytes.NewReader(user.ProfilePicture), nil)
+	if err != nil {
+		return err
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND profile_picture_key = ''", user.ID).
+			Updates(map[string]interface{}{"profile_picture_key": blobKey, "profile_picture": nil})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return batch.commit(tx)
+	})
+}
+
+// resealBlob encrypts a blob written without a vault with the vault key and points
+// the row of model at the result. A blob shared by several rows is read for each of
+// them but sealed only once, later rows find the sealed copy by its content hash.
+func resealBlob(model interface{}, column string, blobKey string) error {
+	var batch blobBatch
+	defer batch.finish()
+
+	newKey, err := writeSealedCopy(&batch, blobKey)
+	if err != nil || newKey == "" {
+		return err
+	}
+	batch.drop(blobKey)
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		// Only if the row was not changed meanwhile
+		result := tx.Model(model).Where(column+" = ?", blobKey).UpdateColumn(column, newKey)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return batch.commit(tx)
+	})
+}
+
+// writeSealedCopy writes a blob's content again with the vault key, returning an
+// empty key if it already is
+func writeSealedCopy(batch *blobBatch, blobKey string) (string, error) {
+	blob, err := Blobs.Open(blobKey)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	if vault.IsSealedStream(blob) {
+		return "", nil
+	}
+
+	newKey, _, err := batch.write(blob, nil)
+	return newKey, err
+}
+
+// moveBlobReferences points the rows of model that refer to oldKey in column at
+// newBlob instead, moving their references along
+func moveBlobReferences(tx *gorm.DB, model interface{}, column string, oldKey string, newBlob models.Blob) error {
+	result := tx.Model(model).Where(column+" = ?", oldKey).UpdateColumn(column, newBlob.Key)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if err := addBlobReferences(tx, newBlob, result.RowsAffected); err != nil {
+		return err
+	}
+	return releaseBlobReferences(tx, oldKey, result.RowsAffected)
+}
+
+// hashBlob fills in the sizes and content hash of a blob registered by
+// CountBlobReferences, and merges it into a blob with the same content if there is
+// one. It reports whether the blob was merged.
+func hashBlob(blobKey string) (bool, error) {
+	hashed, err := hashBlobContent(blobKey)
+	if err != nil {
+		return false, err
+	}
+
+	var existing []models.Blob
+	if err := DB.Where("content_hash = ? AND key <> ?", hashed.ContentHash, blobKey).Limit(1).Find(&existing).Error; err != nil {
+		return false, err
+	}
+
+	// The blob merged into must not be pruned before the references are moved
+	var batch blobBatch
+	defer batch.finish()
+
+	blobPins.Lock()
+	merge := len(existing) > 0 && blobExists(existing[0].Key)
+	if merge {
+		batch.pin(existing[0])
+	}
+	blobPins.Unlock()
+
+	if !merge {
+		return false, DB.Model(&hashed).Select("content_hash", "size", "stored_size").Updates(&hashed).Error
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := moveBlobReferences(tx, &models.Document{}, "blob_key", blobKey, existing[0]); err != nil {
+			return err
+		}
+		if err := moveBlobReferences(tx, &models.RevisionDocument{}, "blob_key", blobKey, existing[0]); err != nil {
+			return err
+		}
+		return moveBlobReferences(tx, &models.User{}, "profile_picture_key", blobKey, existing[0])
+	})
+	if err != nil {
+		return false, err
+	}
+
+	batch.drop(blobKey)
+	return true, nil
+}
+
+// hashBlobContent reads a blob and returns its key, sizes and content hash
+func hashBlobContent(blobKey string) (models.Blob, error) {
+	blob, err := Blobs.Open(blobKey)
+	if err != nil {
+		return models.Blob{}, err
+	}
+	defer blob.Close()
+
+	reader, err := vault.NewReader(blob)
+	if err != nil {
+		return models.Blob{}, err
+	}
+
+	contentHash, err := vault.ContentHash()
+	if err != nil {
+		return models.Blob{}, err
+	}
+
+	size, err := io.Copy(contentHash, reader)
+	if err != nil {
+		return models.Blob{}, err
+	}
+
+	return models.Blob{
+		Key:         blobKey,
+		ContentHash: hex.EncodeToString(contentHash.Sum(nil)),
+		Size:        size,
+		StoredSize:  blob.Size(),
+	}, nil
+}
+
+// addBlobReferences counts count new references to a blob, registering it on its
+// first reference
+func addBlobReferences(tx *gorm.DB, blob models.Blob, count int64) error {
+	if count == 0 {
+		return nil
+	}
+
+	blob.RefCount = int(count)
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"ref_count": gorm.Expr("ref_count + ?", count)}),
+	}).Create(&blob).Error
+}
+
+func releaseBlobReferences(tx *gorm.DB, blobKey string, count int64) error {
+	if count == 0 {
+		return nil
+	}
+	return tx.Model(&models.Blob{}).Where("key = ?", blobKey).UpdateColumn("ref_count", gorm.Expr("ref_count - ?", count)).Error
+}
+
+// deleteUnreferencedBlobs deletes the given blobs unless a row refers to them or a
+// pending change pinned them
+func deleteUnreferencedBlobs(blobKeys []string) {
+	for _, blobKey := range blobKeys {
+		deleted, err := deleteUnreferencedBlob(blobKey)
+		if err != nil {
+			log.Printf("Failed to delete blob %s: %v", blobKey, err)
+			continue
+		}
+
+		// The row goes after the file: a change that reuses the content meanwhile
+		// stores it again and counts its reference on the row or a new one
+		if deleted {
+			if err := DB.Where("key = ? AND ref_count <= 0", blobKey).Delete(&models.Blob{}).Error; err != nil {
+				log.Printf("Failed to delete blob %s: %v", blobKey, err)
+			}
+		}
+	}
+}
+
+func deleteUnreferencedBlob(blobKey string) (bool, error) {
+	blobPins.Lock()
+	defer blobPins.Unlock()
+
+	if blobPins.counts[blobKey] > 0 {
+		return false, nil
+	}
+
+	var refCounts []int
+	if err := DB.Model(&models.Blob{}).Where("key = ?", blobKey).Pluck("ref_count", &refCounts).Error; err != nil {
+		return false, err
+	}
+	if len(refCounts) > 0 && refCounts[0] > 0 {
+		return false, nil
+	}
+
+	if err := Blobs.Delete(blobKey); err != nil {
+		return false, err
+	}
+
+	// Thumbnails are cached by the key of their source
+	if Thumbnails != nil {
+		if err := Thumbnails.Delete(blobKey); err != nil {
+			log.Printf("Failed to delete thumbnails of blob %s: %v", blobKey, err)
+		}
+	}
+	return true, nil
+}
+
+func blobExists(blobKey string) bool {
+	blob, err := Blobs.Open(blobKey)
+	if err != nil {
+		return false
+	}
+	blob.Close()
+	return true
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yana-back/blobstore"
+	"yana-back/models"
+
+	"gorm.io/gorm"
+)
+
+var errRollback = errors.New("rolled back")
+
+func TestBlobBatchCommit(t *testing.T) {
+	setupBlobStore(t)
+
+	blobKey := writeDocumentBlob(t, "content", nil)
+
+	checkBlob(t, blobKey, 1)
+}
+
+func TestBlobBatchRollback(t *testing.T) {
+	setupBlobStore(t)
+
+	blobKey := writeDocumentBlob(t, "content", errRollback)
+
+	checkBlob(t, blobKey, -1)
+}
+
+func TestBlobBatchSharesContent(t *testing.T) {
+	setupBlobStore(t)
+
+	first := writeDocumentBlob(t, "content", nil)
+	second := writeDocumentBlob(t, "content", nil)
+	if first != second {
+		t.Fatalf("identical contents got blobs %s and %s", first, second)
+	}
+	checkBlob(t, first, 2)
+
+	// A rolled back write of the same content leaves the shared blob alone
+	if rolledBack := writeDocumentBlob(t, "content", errRollback); rolledBack != first {
+		t.Fatalf("identical content got blob %s, want %s", rolledBack, first)
+	}
+	checkBlob(t, first, 2)
+}
+
+func TestBlobBatchDropCommit(t *testing.T) {
+	setupBlobStore(t)
+
+	blobKey := writeDocumentBlob(t, "content", nil)
+	writeDocumentBlob(t, "content", nil)
+
+	dropDocumentBlob(t, blobKey, nil)
+	checkBlob(t, blobKey, 1)
+
+	// Dropping the last reference deletes the blob
+	dropDocumentBlob(t, blobKey, nil)
+	checkBlob(t, blobKey, -1)
+}
+
+func TestBlobBatchDropRollback(t *testing.T) {
+	setupBlobStore(t)
+
+	blobKey := writeDocumentBlob(t, "content", nil)
+
+	dropDocumentBlob(t, blobKey, errRollback)
+	checkBlob(t, blobKey, 1)
+}
+
+func TestBlobBatchPinsUncommittedWrites(t *testing.T) {
+	setupBlobStore(t)
+
+	var batch blobBatch
+	blobKey, _, err := batch.write(strings.NewReader("content"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing refers to the blob yet, but the change writing it is still pending
+	deleteUnreferencedBlobs([]string{blobKey})
+	if !blobExists(blobKey) {
+		t.Fatal("blob of a pending change was deleted")
+	}
+
+	batch.finish()
+	checkBlob(t, blobKey, -1)
+}
+
+// setupBlobStore points DB and Blobs at an empty database and blob store
+func setupBlobStore(t *testing.T) {
+	t.Helper()
+	setupTestDB(t)
+
+	store, err := blobstore.NewFileStore(filepath.Join(t.TempDir(), "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldBlobs := Blobs
+	Blobs = store
+	t.Cleanup(func() { Blobs = oldBlobs })
+}
+
+// writeDocumentBlob stores content for a new attachment in a change that fails with
+// failure, nil to commit it
+func writeDocumentBlob(t *testing.T, content string, failure error) string {
+	t.Helper()
+	var batch blobBatch
+	defer batch.finish()
+
+	blobKey, size, err := batch.write(strings.NewReader(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		document := models.Document{UserId: 1, NoteId: 1, Name: "file.txt", BlobKey: blobKey, Size: size}
+		if err := tx.Create(&document).Error; err != nil {
+			return err
+		}
+		if err := batch.commit(tx); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatal(err)
+	}
+	return blobKey
+}
+
+// dropDocumentBlob deletes one attachment referring to blobKey in a change that
+// fails with failure, nil to commit it
+func dropDocumentBlob(t *testing.T, blobKey string, failure error) {
+	t.Helper()
+	var batch blobBatch
+	defer batch.finish()
+
+	var document models.Document
+	if err := DB.Omit("data").Where("blob_key = ?", blobKey).First(&document).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := deleteDocuments(&batch, tx.Where("id = ?", document.ID)); err != nil {
+			return err
+		}
+		if err := batch.commit(tx); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatal(err)
+	}
+}
+
+// checkBlob compares the blob's reference count with refCount, -1 if the blob must
+// be gone, and checks the count matches the rows referring to it
+func checkBlob(t *testing.T, blobKey string, refCount int) {
+	t.Helper()
+
+	var blobs []models.Blob
+	if err := DB.Where("key = ?", blobKey).Find(&blobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if refCount < 0 {
+		if len(blobs) > 0 {
+			t.Errorf("blob row kept with %d references", blobs[0].RefCount)
+		}
+		if blobExists(blobKey) {
+			t.Error("blob file kept")
+		}
+		return
+	}
+
+	if len(blobs) == 0 {
+		t.Fatal("blob row missing")
+	}
+	if blobs[0].RefCount != refCount {
+		t.Errorf("blob has %d references, want %d", blobs[0].RefCount, refCount)
+	}
+	if !blobExists(blobKey) {
+		t.Error("blob file missing")
+	}
+
+	var rows int64
+	if err := DB.Model(&models.Document{}).Where("blob_key = ?", blobKey).Count(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rows != int64(blobs[0].RefCount) {
+		t.Errorf("%d attachments refer to the blob, but it counts %d references", rows, blobs[0].RefCount)
+	}
+}
@@ -1,49 +1,495 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"yana-back/models"
 
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 )
 
+// GetDocument sends an attachment or background picture, supporting range and
+// conditional requests
 func GetDocument(c echo.Context) error {
-	id := c.Param("id")
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
 
-	// Assume you have a GORM database instance
-	var document models.Document
+	documentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid document ID"})
+	}
 
-	// Fetch the document from the DB by its ID
-	if err := DB.First(&document, id).Error; err != nil {
+	var document models.Document
+	if err := DB.Scopes(ownedBy(userID)).First(&document, documentID).Error; err != nil {
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "Document not found"})
 	}
 
-	// Set the Content-Disposition header to include the file name
-	c.Response().Header().Set("Content-Disposition", "attachment; filename="+document.Name)
-	// Return the file as a blob response with the correct MIME type
-	return c.Blob(http.StatusOK, *document.Type, document.Data)
+	key, err := requireDocumentAccess(document, userID)
+	if err != nil {
+		return err
+	}
+
+	return serveDocument(c, document, key)
 }
 
+// GetNoteDocumentByName sends a note's attachment found by its file name
 func GetNoteDocumentByName(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
 	noteId := c.Param("id")
 	documentName := c.Param("documentName")
 
-	var document models.Document
-
-	// Query by note_id and name
-	if err := DB.Where("note_id = ? AND name = ?", noteId, documentName).First(&document).Error; err != nil {
+	document, err := findNoteDocumentByName(userID, noteId, documentName)
+	if err != nil {
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "Document not found"})
 	}
 
-	// Set content-disposition header so browsers treat it as a file
-	c.Response().Header().Set("Content-Disposition", "attachment; filename=\""+document.Name+"\"")
+	key, err := requireDocumentAccess(document, userID)
+	if err != nil {
+		return err
+	}
+
+	return serveDocument(c, document, key)
+}
+
+// findNoteDocumentByName compares names in Go because vault mode encrypts them
+func findNoteDocumentByName(userID uint, noteID string, name string) (models.Document, error) {
+	var documents []models.Document
+	if err := DB.Scopes(ownedBy(userID)).Select("id", "name").Where("note_id = ?", noteID).Find(&documents).Error; err != nil {
+		return models.Document{}, err
+	}
+
+	for _, document := range documents {
+		if document.Name == name {
+			err := DB.First(&document, document.ID).Error
+			return document, err
+		}
+	}
+
+	return models.Document{}, gorm.ErrRecordNotFound
+}
+
+// AddNoteDocumentsHandler attaches the uploaded files to a note after its existing attachments
+func AddNoteDocumentsHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	note, key, err := findAccessibleNote(c, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkStorageQuota(c, userID, 0, "documents"); err != nil {
+		return err
+	}
+
+	var batch blobBatch
+	defer batch.finish()
+
+	documents, err := readDocuments(c, &batch, userID, key)
+	if err != nil {
+		return err
+	}
+	if len(documents) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No documents provided"})
+	}
+
+	if err := checkNoteDocumentsVersion(c, note); err != nil {
+		return err
+	}
+
+	err = changeNoteDocuments(c, &batch, &note, key, func(tx *gorm.DB) error {
+		var last struct{ Position *int }
+		if err := tx.Model(&models.Document{}).Select("MAX(position) AS position").Where("note_id = ?", note.ID).Scan(&last).Error; err != nil {
+			return err
+		}
+
+		next := 0
+		if last.Position != nil {
+			next = *last.Position + 1
+		}
+
+		for i := range documents {
+			documents[i].NoteId = note.ID
+			documents[i].Position = next + i
+			if err := tx.Create(&documents[i]).Error; err != nil {
+				return err
+			}
+		}
+		return recheckStorageQuota(tx, userID)
+	})
+	if isHTTPError(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to add documents: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add documents"})
+	}
+
+	return respondWithNoteDocuments(c, note, userID)
+}
+
+// DeleteDocumentHandler removes a single attachment from its note
+func DeleteDocumentHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	document, note, key, err := findAttachment(c, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkNoteDocumentsVersion(c, note); err != nil {
+		return err
+	}
+
+	var batch blobBatch
+	defer batch.finish()
+
+	err = changeNoteDocuments(c, &batch, &note, key, func(tx *gorm.DB) error {
+		return deleteDocuments(&batch, tx.Where("id = ?", document.ID))
+	})
+	if isHTTPError(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to delete document: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete document"})
+	}
+
+	return respondWithNoteDocuments(c, note, userID)
+}
+
+// RenameDocumentHandler changes the file name of a single attachment
+func RenameDocumentHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid document name"})
+	}
+
+	document, note, key, err := findAttachment(c, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkNoteDocumentsVersion(c, note); err != nil {
+		return err
+	}
+
+	var batch blobBatch
+	defer batch.finish()
+
+	document.Name = name
+	err = changeNoteDocuments(c, &batch, &note, key, func(tx *gorm.DB) error {
+		return tx.Model(&document).Select("name").Updates(&document).Error
+	})
+	if isHTTPError(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to rename document: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to rename document"})
+	}
+
+	return respondWithNoteDocuments(c, note, userID)
+}
+
+// ReorderNoteDocumentsHandler puts a note's attachments in the order given by the
+// `order` form values, a full list of the note's document IDs
+func ReorderNoteDocumentsHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	note, key, err := findAccessibleNote(c, userID)
+	if err != nil {
+		return err
+	}
+
+	order, err := parseDocumentOrder(c)
+	if err != nil {
+		return err
+	}
+
+	if err := checkNoteDocumentsVersion(c, note); err != nil {
+		return err
+	}
+
+	var documentIDs []uint
+	if err := DB.Model(&models.Document{}).Where("note_id = ?", note.ID).Pluck("id", &documentIDs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch documents"})
+	}
+
+	if !sameDocumentIDs(order, documentIDs) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "The order must list every document of the note exactly once"})
+	}
+
+	var batch blobBatch
+	defer batch.finish()
+
+	err = changeNoteDocuments(c, &batch, &note, key, func(tx *gorm.DB) error {
+		for position, documentID := range order {
+			if err := tx.Model(&models.Document{}).Where("id = ?", documentID).UpdateColumn("position", position).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isHTTPError(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to reorder documents: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reorder documents"})
+	}
+
+	return respondWithNoteDocuments(c, note, userID)
+}
+
+// Helper functions
+
+// serveDocument sends an attachment's content. http.ServeContent answers range
+// requests with 206 and conditional requests with 304 against the ETag and
+// Last-Modified headers.
+func serveDocument(c echo.Context, document models.Document, key []byte) error {
+	reader, err := openDocument(document, key)
+	if err != nil {
+		log.Printf("Failed to open document %d: %v", document.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decrypt document"})
+	}
+	defer reader.Close()
 
-	// Default MIME type fallback if nil
 	contentType := "application/octet-stream"
-	if document.Type != nil {
+	if document.Type != nil && *document.Type != "" {
 		contentType = *document.Type
 	}
-	fmt.Println("HI")
-	return c.Blob(http.StatusOK, contentType, document.Data)
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, contentType)
+	header.Set(echo.HeaderContentDisposition, contentDisposition(contentType, document.Name))
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	header.Set("ETag", documentETag(document))
+	// Cached copies are revalidated, so a locked note's attachments are not served
+	// from the cache once its access expired
+	header.Set(echo.HeaderCacheControl, "private, no-cache")
+
+	http.ServeContent(c.Response(), c.Request(), "", document.UpdatedAt, reader)
+	return nil
+}
+
+// documentETag changes whenever an attachment's content or name does
+func documentETag(document models.Document) string {
+	return `"` + documentVersion(document) + `"`
+}
+
+func documentVersion(document models.Document) string {
+	content := "d" + strconv.FormatUint(uint64(document.ID), 10)
+	if document.BlobKey != "" {
+		content = document.BlobKey[:16]
+	}
+	return fmt.Sprintf("%s-%x", content, document.UpdatedAt.UnixNano())
+}
+
+// contentDisposition lets the browser show media and PDFs in place and downloads
+// everything else, with the file name encoded as in RFC 5987 when needed
+func contentDisposition(contentType, name string) string {
+	disposition := "attachment"
+	if inlineContentType(contentType) {
+		disposition = "inline"
+	}
+
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": name}); value != "" {
+		return value
+	}
+	return disposition
+}
+
+// inlineContentType reports whether a file of the given type can be shown in place
+// safely; markup such as HTML or SVG could run scripts
+func inlineContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	return mediaType == "application/pdf" || mediaType == "text/plain"
+}
+
+// byPosition orders attachments the way the user arranged them
+func byPosition(db *gorm.DB) *gorm.DB {
+	return db.Order("position, id")
+}
+
+// findAccessibleNote loads the note named by the id path parameter and returns the
+// key of its attachments, rejecting locked notes that were not unlocked
+func findAccessibleNote(c echo.Context, userID uint) (models.Note, []byte, error) {
+	noteID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return models.Note{}, nil, jsonError(http.StatusBadRequest, "Invalid note ID")
+	}
+
+	var note models.Note
+	if err := DB.Scopes(ownedBy(userID)).First(&note, noteID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return models.Note{}, nil, jsonError(http.StatusNotFound, "Note not found")
+		}
+		return models.Note{}, nil, jsonError(http.StatusInternalServerError, "Failed to fetch note")
+	}
+
+	key, err := requireNoteAccess(note, userID)
+	return note, key, err
+}
+
+// findAttachment loads the note attachment named by the id path parameter with its
+// note and the note's key; background pictures are managed through their note
+func findAttachment(c echo.Context, userID uint) (models.Document, models.Note, []byte, error) {
+	documentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return models.Document{}, models.Note{}, nil, jsonError(http.StatusBadRequest, "Invalid document ID")
+	}
+
+	var document models.Document
+	err = DB.Scopes(ownedBy(userID)).Omit("data").Where("note_id > 0").First(&document, documentID).Error
+	if err != nil {
+		return models.Document{}, models.Note{}, nil, jsonError(http.StatusNotFound, "Document not found")
+	}
+
+	var note models.Note
+	if err := DB.Scopes(ownedBy(userID)).First(&note, document.NoteId).Error; err != nil {
+		return models.Document{}, models.Note{}, nil, jsonError(http.StatusNotFound, "Document not found")
+	}
+
+	key, err := requireNoteAccess(note, userID)
+	if err != nil {
+		return models.Document{}, models.Note{}, nil, err
+	}
+	return document, note, key, nil
+}
+
+// checkNoteDocumentsVersion rejects an attachment edit based on an older version of
+// the note, read from If-Match or the version form field like a content edit
+func checkNoteDocumentsVersion(c echo.Context, note models.Note) error {
+	version, err := formInt(c, "version")
+	if err != nil {
+		return jsonError(http.StatusBadRequest, "Invalid note version")
+	}
+	return checkNoteVersion(c, note, noteInput{Version: version})
+}
+
+// changeNoteDocuments runs an attachment edit in one transaction with claiming the
+// note's next version, so it conflicts with concurrent saves of the note, and with
+// recording the new version in the note's history
+func changeNoteDocuments(c echo.Context, batch *blobBatch, note *models.Note, key []byte, change func(tx *gorm.DB) error) error {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := bumpNoteVersion(tx, note); err != nil {
+			return err
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		if err := recordNoteRevision(tx, batch, note, key); err != nil {
+			log.Printf("Failed to record revision: %v", err)
+			return jsonError(http.StatusInternalServerError, "Failed to record revision")
+		}
+		return batch.commit(tx)
+	})
+	if errors.Is(err, errVersionConflict) {
+		return noteConflict(c, note.ID, note.UserId)
+	}
+	return err
+}
+
+// parseDocumentOrder reads document IDs from repeated or comma separated `order` values
+func parseDocumentOrder(c echo.Context) ([]uint, error) {
+	params, err := c.FormParams()
+	if err != nil {
+		return nil, jsonError(http.StatusBadRequest, "Invalid form")
+	}
+
+	var order []uint
+	for _, value := range params["order"] {
+		for _, field := range strings.Split(value, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64)
+			if err != nil {
+				return nil, jsonError(http.StatusBadRequest, "Invalid document ID in order")
+			}
+			order = append(order, uint(id))
+		}
+	}
+	return order, nil
+}
+
+// sameDocumentIDs reports whether order is a permutation of ids
+func sameDocumentIDs(order, ids []uint) bool {
+	if len(order) != len(ids) {
+		return false
+	}
+
+	remaining := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		remaining[id] = true
+	}
+	for _, id := range order {
+		if !remaining[id] {
+			return false
+		}
+		delete(remaining, id)
+	}
+	return true
+}
+
+func respondWithNoteDocuments(c echo.Context, note models.Note, userID uint) error {
+	var documents []models.Document
+	if err := DB.Scopes(ownedBy(userID), byPosition).Omit("data").Where("note_id = ?", note.ID).Find(&documents).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch documents"})
+	}
+
+	setNoteETag(c, note)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"noteId":    note.ID,
+		"version":   note.Version,
+		"documents": buildDocumentsResponse(documents),
+	})
+}
+
+func buildDocumentsResponse(documents []models.Document) []map[string]interface{} {
+	response := []map[string]interface{}{}
+	for _, document := range documents {
+		response = append(response, map[string]interface{}{
+			"id":       document.ID,
+			"name":     document.Name,
+			"type":     document.Type,
+			"position": document.Position,
+		})
+	}
+	return response
 }
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	GarbageCollectionInterval = 24 * time.Hour
+
+	// garbageBatchSize bounds the documents deleted in one transaction
+	garbageBatchSize = 500
+)
+
+// garbageCollection keeps collections started on schedule and on demand apart
+var garbageCollection sync.Mutex
+
+// GarbageReport describes what a garbage collection removed, or would remove in a
+// dry run
+type GarbageReport struct {
+	DryRun    bool             `json:"dryRun"`
+	Documents []OrphanDocument `json:"documents"`
+	// Size is the total size of the orphaned documents
+	Size int64 `json:"size"`
+	// StrayBlobs are stored contents no row refers to, left by an interrupted write
+	StrayBlobs int `json:"strayBlobs"`
+	// Thumbnails are cached renditions of contents that are gone
+	Thumbnails int `json:"thumbnails"`
+	// FreeBytes is the unused database space a vacuum gives back
+	FreeBytes int64 `json:"freeBytes"`
+}
+
+// OrphanDocument is an attachment or background picture nothing refers to anymore
+type OrphanDocument struct {
+	ID     uint   `json:"id"`
+	UserID uint   `json:"userId"`
+	NoteID uint   `json:"noteId"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// CollectGarbageHandler removes orphaned documents, stray blobs and stale thumbnails
+// and vacuums the database; with ?dryRun=true it only reports what it would remove.
+// Every profile's garbage is collected, but only the user's own documents are listed.
+func CollectGarbageHandler(c echo.Context) error {
+	dryRun := false
+	if value := c.QueryParam("dryRun"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid dryRun value"})
+		}
+	}
+
+	report, err := collectGarbage(c.Request().Context(), dryRun)
+	if err != nil {
+		log.Printf("Failed to collect garbage: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to collect garbage"})
+	}
+
+	return c.JSON(http.StatusOK, userGarbageReport(report, sessionUserID(c)))
+}
+
+// CollectGarbage is the scheduled garbage collection
+func CollectGarbage(ctx context.Context) error {
+	report, err := collectGarbage(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	if len(report.Documents) > 0 || report.StrayBlobs > 0 || report.Thumbnails > 0 {
+		log.Printf("Collected %d orphaned documents (%d bytes), %d stray blobs and %d stale thumbnails",
+			len(report.Documents), report.Size, report.StrayBlobs, report.Thumbnails)
+	}
+	return nil
+}
+
+// Helper functions
+
+func collectGarbage(ctx context.Context, dryRun bool) (GarbageReport, error) {
+	garbageCollection.Lock()
+	defer garbageCollection.Unlock()
+
+	report := GarbageReport{DryRun: dryRun, Documents: []OrphanDocument{}}
+
+	documents, err := collectOrphanDocuments(ctx, dryRun)
+	if err != nil {
+		return report, fmt.Errorf("failed to collect documents: %w", err)
+	}
+	report.Documents = append(report.Documents, documents...)
+	for _, document := range documents {
+		report.Size += document.Size
+	}
+
+	if report.StrayBlobs, err = collectStrayBlobs(ctx, dryRun); err != nil {
+		return report, fmt.Errorf("failed to collect blobs: %w", err)
+	}
+
+	if report.Thumbnails, err = collectStaleThumbnails(ctx, dryRun); err != nil {
+		return report, fmt.Errorf("failed to collect thumbnails: %w", err)
+	}
+
+	if report.FreeBytes, err = vacuumDatabase(ctx, dryRun); err != nil {
+		return report, fmt.Errorf("failed to vacuum database: %w", err)
+	}
+
+	return report, nil
+}
+
+// userGarbageReport leaves the documents of other profiles out of a report
+func userGarbageReport(report GarbageReport, userID uint) GarbageReport {
+	documents := []OrphanDocument{}
+	report.Size = 0
+	for _, document := range report.Documents {
+		if document.UserID == userID {
+			documents = append(documents, document)
+			report.Size += document.Size
+		}
+	}
+	report.Documents = documents
+	return report
+}
+
+// findOrphanDocuments lists the documents whose note is gone and those without a note,
+// background pictures or not, that no note shows. Notes are matched in plain SQL so that those
+// in the trash keep their documents.
+func findOrphanDocuments(db *gorm.DB, limit int) ([]OrphanDocument, error) {
+	var documents []OrphanDocument
+	err := db.Raw(`SELECT id, user_id, note_id, size,
+			CASE
+				WHEN note_id = 0 THEN 'no note'
+				ELSE 'missing note'
+			END AS reason
+		FROM documents
+		WHERE (note_id = 0 AND NOT EXISTS (SELECT 1 FROM notes WHERE notes.b_picture_id = documents.id))
+			OR (note_id > 0 AND NOT EXISTS (SELECT 1 FROM notes WHERE notes.id = documents.note_id))
+		ORDER BY id
+		LIMIT ?`, limit).Scan(&documents).Error
+	return documents, err
+}
+
+// collectOrphanDocuments deletes the orphaned documents in batches, each found again
+// in the transaction that deletes it
+func collectOrphanDocuments(ctx context.Context, dryRun bool) ([]OrphanDocument, error) {
+	if dryRun {
+		return findOrphanDocuments(DB, -1)
+	}
+
+	var collected []OrphanDocument
+	for ctx.Err() == nil {
+		var batch blobBatch
+		var documents []OrphanDocument
+
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if documents, err = findOrphanDocuments(tx, garbageBatchSize); err != nil || len(documents) == 0 {
+				return err
+			}
+
+			ids := make([]uint, len(documents))
+			for i, document := range documents {
+				ids[i] = document.ID
+			}
+			if err := deleteDocuments(&batch, tx.Where("id IN ?", ids)); err != nil {
+				return err
+			}
+			return batch.commit(tx)
+		})
+		batch.finish()
+		if err != nil {
+			return collected, err
+		}
+
+		collected = append(collected, documents...)
+		if len(documents) < garbageBatchSize {
+			break
+		}
+	}
+	return collected, ctx.Err()
+}
+
+// collectStrayBlobs deletes stored contents without a blobs row. Writes in progress
+// are safe: their blobs are pinned until the row is committed.
+func collectStrayBlobs(ctx context.Context, dryRun bool) (int, error) {
+	known, err := knownBlobKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	var stray []string
+	err = Blobs.Walk(func(key string) error {
+		if !known[key] {
+			stray = append(stray, key)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if !dryRun {
+		deleteUnreferencedBlobs(stray)
+	}
+	return len(stray), nil
+}
+
+// collectStaleThumbnails deletes the cached thumbnails of blobs that are gone
+func collectStaleThumbnails(ctx context.Context, dryRun bool) (int, error) {
+	if Thumbnails == nil {
+		return 0, nil
+	}
+
+	known, err := knownBlobKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := Thumbnails.Keys()
+	if err != nil {
+		return 0, err
+	}
+
+	stale := 0
+	for _, key := range keys {
+		if known[key] || ctx.Err() != nil {
+			continue
+		}
+		stale++
+		if !dryRun {
+			if err := Thumbnails.Delete(key); err != nil {
+				log.Printf("Failed to delete thumbnails of blob %s: %v", key, err)
+			}
+		}
+	}
+	return stale, ctx.Err()
+}
+
+func knownBlobKeys() (map[string]bool, error) {
+	var keys []string
+	if err := DB.Model(&models.Blob{}).Pluck("key", &keys).Error; err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		known[key] = true
+	}
+	return known, nil
+}
+
+// vacuumDatabase rebuilds the database file without its unused pages and returns the
+// space they took
+func vacuumDatabase(ctx context.Context, dryRun bool) (int64, error) {
+	var freePages, pageSize int64
+	if err := DB.Raw("PRAGMA freelist_count").Scan(&freePages).Error; err != nil {
+		return 0, err
+	}
+	if err := DB.Raw("PRAGMA page_size").Scan(&pageSize).Error; err != nil {
+		return 0, err
+	}
+
+	if !dryRun && freePages > 0 && ctx.Err() == nil {
+		if err := DB.Exec("VACUUM").Error; err != nil {
+			return 0, err
+		}
+	}
+	return freePages * pageSize, nil
+}
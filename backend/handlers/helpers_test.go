@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testModels are the tables of the test database
+var testModels = []interface{}{
+	&models.User{}, &models.Note{}, &models.Document{}, &models.AuthThrottle{}, &models.AuthEvent{}, &models.RecoveryCode{},
+	&models.Blob{}, &models.NoteRevision{}, &models.RevisionDocument{},
+}
+
+// setupTestDB points DB at an empty database; concurrent requests wait for each
+// other's writes instead of failing
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "test.sqlite") + "?_busy_timeout=5000"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(testModels...); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDB := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = oldDB
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// createTestUser stores a user with the given password, none if empty
+func createTestUser(t *testing.T, password string) models.User {
+	t.Helper()
+	user := models.User{Name: "test"}
+	if password != "" {
+		hashedPassword, err := hashPassword(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Password = hashedPassword
+	}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// postForm sends form to the route at target and returns the response
+func postForm(e *echo.Echo, target string, form url.Values) *httptest.ResponseRecorder {
+	return postFormWithToken(e, target, form, "")
+}
+
+// postFormWithToken sends form in the session of token, none if empty
+func postFormWithToken(e *echo.Echo, target string, form url.Values, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
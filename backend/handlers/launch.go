@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	LaunchSecretHeader     = "X-Yana-Secret"
+	LaunchSecretQueryParam = "secret"
+)
+
+// LaunchSecret is generated by the desktop shell for each launch; requests that do
+// not carry it come from somewhere else and are rejected
+var LaunchSecret string
+
+// RequireLaunchSecret rejects every request that does not carry the launch secret
+func RequireLaunchSecret(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		secret := c.Request().Header.Get(LaunchSecretHeader)
+		if secret == "" {
+			// Fallback for resources loaded by the browser directly, e.g. <img src>
+			secret = c.QueryParam(LaunchSecretQueryParam)
+		}
+
+		if LaunchSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(LaunchSecret)) != 1 {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Missing or invalid launch secret"})
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"yana-back/crypt"
+	"yana-back/models"
+	"yana-back/vault"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	NoteUnlockTTL = 15 * time.Minute
+)
+
+// noteGrantKey identifies an unlocked note within a user's sessions
+type noteGrantKey struct {
+	UserID uint
+	NoteID uint
+}
+
+// noteGrant keeps the key of an unlocked note for a limited time
+type noteGrant struct {
+	Key       []byte
+	ExpiresAt time.Time
+}
+
+// noteGrants remembers which locked notes were recently unlocked by their owner
+var noteGrants = struct {
+	sync.Mutex
+	grants map[noteGrantKey]noteGrant
+}{grants: make(map[noteGrantKey]noteGrant)}
+
+// UnlockNoteHandler checks a note's password and returns its content and attachments
+func UnlockNoteHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	noteID, err := parseNoteID(c)
+	if err != nil {
+		return err
+	}
+
+	var note models.Note
+	if err := DB.Scopes(ownedBy(userID)).Preload("Documents", byPosition).First(&note, noteID).Error; err != nil {
+		return handleDBError(c, err, "Note not found", "Failed to fetch note")
+	}
+
+	if !note.IsLocked() {
+		setNoteETag(c, note)
+		return c.JSON(http.StatusOK, buildNoteResponse(note, true))
+	}
+
+	release, err := checkThrottle(c, ThrottleScopeNote, note.ID, "")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	password := c.FormValue("password")
+	if !checkPassword(note.Password, password) {
+		recordFailedAttempt(c, ThrottleScopeNote, note.ID)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid note password"})
+	}
+	recordSuccessfulAttempt(c, ThrottleScopeNote, note.ID)
+
+	key, err := unlockNoteKey(note, password)
+	if err != nil {
+		log.Printf("Failed to unlock note %d: %v", note.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to unlock note"})
+	}
+
+	if err := openNote(&note, key); err != nil {
+		log.Printf("Failed to decrypt note %d: %v", note.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decrypt note"})
+	}
+
+	grantNoteAccess(userID, note.ID, key)
+	setNoteETag(c, note)
+	return c.JSON(http.StatusOK, buildNoteResponse(note, true))
+}
+
+// EncryptLegacyLockedNotes replaces note passwords stored before hashing was
+// introduced and, while the plaintext password is at hand, encrypts the note's
+// content, attachments and revisions with the key derived from it. It needs the blob
+// store, and in vault mode an unlocked vault.
+func EncryptLegacyLockedNotes() error {
+	if !vault.Unlocked() {
+		return nil // Called again once the vault is unlocked
+	}
+
+	var notes []models.Note
+	// Notes in the trash are included, they can still be restored
+	if err := DB.Unscoped().Select("id", "password").Where("password <> ''").Find(&notes).Error; err != nil {
+		return err
+	}
+
+	for _, note := range notes {
+		if _, err := bcrypt.Cost([]byte(note.Password)); err == nil {
+			continue // Already hashed
+		}
+
+		if err := encryptLegacyNote(note.ID); err != nil {
+			return fmt.Errorf("failed to encrypt note %d: %w", note.ID, err)
+		}
+		log.Printf("Hashed the plaintext password of note %d and encrypted it", note.ID)
+	}
+
+	return nil
+}
+
+// PruneNoteGrants forgets the keys of unlocked notes whose access has expired
+func PruneNoteGrants(ctx context.Context) error {
+	noteGrants.Lock()
+	defer noteGrants.Unlock()
+
+	now := time.Now()
+	for grantKey, grant := range noteGrants.grants {
+		if now.After(grant.ExpiresAt) {
+			delete(noteGrants.grants, grantKey)
+		}
+	}
+	return nil
+}
+
+// Helper functions
+
+// applyNotePassword sets, keeps or removes a note's password from the request and
+// returns the key its content must be encrypted with, nil for an unlocked note
+func applyNotePassword(note *models.Note, input noteInput, key []byte) ([]byte, error) {
+	password := stringValue(input.Password)
+	switch {
+	case password != "" && key != nil && checkPassword(note.Password, password):
+		// Clients send the password along with every save; the same password keeps
+		// the key, so nothing has to be re-encrypted
+	case password != "":
+		hashedPassword, err := hashPassword(password)
+		if err != nil {
+			return nil, jsonError(http.StatusInternalServerError, "Failed to hash password")
+		}
+
+		salt, err := crypt.NewSalt()
+		if err != nil {
+			return nil, jsonError(http.StatusInternalServerError, "Failed to derive note key")
+		}
+
+		note.Password = hashedPassword
+		note.KeySalt = salt
+		key = crypt.DeriveKey(password, salt)
+	case input.RemovePassword != nil && *input.RemovePassword:
+		note.Password = ""
+		note.KeySalt = nil
+		key = nil
+	}
+
+	if input.EncryptTitle != nil {
+		note.TitleEncrypted = *input.EncryptTitle
+	}
+	note.TitleEncrypted = note.TitleEncrypted && note.IsLocked()
+
+	return key, nil
+}
+
+// unlockNoteKey derives the key of a locked note, encrypting notes that were locked
+// before encryption at rest existed
+func unlockNoteKey(note models.Note, password string) ([]byte, error) {
+	var batch blobBatch
+	defer batch.finish()
+
+	if note.IsEncrypted() {
+		key := crypt.DeriveKey(password, note.KeySalt)
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := rekeyNoteDocuments(tx, &batch, note.ID, note.UserId, key, key); err != nil {
+				return err
+			}
+			return batch.commit(tx)
+		})
+		return key, err
+	}
+
+	salt, err := crypt.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	key := crypt.DeriveKey(password, salt)
+
+	note.KeySalt = salt
+	if err := sealNote(&note, key); err != nil {
+		return nil, err
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := rekeyNoteDocuments(tx, &batch, note.ID, note.UserId, nil, key); err != nil {
+			return err
+		}
+		if err := rekeyNoteRevisions(tx, &batch, note.ID, nil, key); err != nil {
+			return err
+		}
+
+		// Update through the struct so vault columns go through their serializer
+		if err := tx.Model(&note).Select("key_salt", "content", "title").UpdateColumns(&note).Error; err != nil {
+			return fmt.Errorf("failed to save encrypted note: %w", err)
+		}
+		return batch.commit(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// encryptLegacyNote hashes a plaintext note password and encrypts the note with it in
+// one transaction
+func encryptLegacyNote(noteID uint) error {
+	var batch blobBatch
+	defer batch.finish()
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var note models.Note
+		if err := tx.Unscoped().First(&note, noteID).Error; err != nil {
+			return err
+		}
+		password := note.Password
+
+		hashedPassword, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		if !note.IsEncrypted() {
+			salt, err := crypt.NewSalt()
+			if err != nil {
+				return err
+			}
+			key := crypt.DeriveKey(password, salt)
+
+			note.KeySalt = salt
+			if err := sealNote(&note, key); err != nil {
+				return err
+			}
+			if err := rekeyNoteDocuments(tx, &batch, note.ID, note.UserId, nil, key); err != nil {
+				return err
+			}
+			if err := rekeyNoteRevisions(tx, &batch, note.ID, nil, key); err != nil {
+				return err
+			}
+		}
+		note.Password = hashedPassword
+
+		// Update through the struct so vault columns go through their serializer
+		if err := tx.Unscoped().Model(&note).Select("password", "key_salt", "content", "title").UpdateColumns(&note).Error; err != nil {
+			return err
+		}
+		return batch.commit(tx)
+	})
+}
+
+// sealNote encrypts a note's content, and its title if requested, before it is stored
+func sealNote(note *models.Note, key []byte) error {
+	if key == nil {
+		return nil
+	}
+
+	content, err := crypt.SealString(key, note.Content)
+	if err != nil {
+		return err
+	}
+	note.Content = content
+
+	if note.TitleEncrypted {
+		title, err := crypt.SealString(key, note.Title)
+		if err != nil {
+			return err
+		}
+		note.Title = title
+	}
+
+	return nil
+}
+
+// openNote reverses sealNote on a note loaded from the database
+func openNote(note *models.Note, key []byte) error {
+	if !note.IsEncrypted() {
+		return nil
+	}
+
+	content, err := crypt.OpenString(key, note.Content)
+	if err != nil {
+		return err
+	}
+	note.Content = content
+
+	if note.TitleEncrypted {
+		title, err := crypt.OpenString(key, note.Title)
+		if err != nil {
+			return err
+		}
+		note.Title = title
+	}
+
+	return nil
+}
+
+// documentData returns the plaintext of an attachment stored in the database
+func documentData(document models.Document, key []byte) ([]byte, error) {
+	if !document.Encrypted {
+		return document.Data, nil
+	}
+	return crypt.Open(key, document.Data)
+}
+
+// rekeyNoteDocuments re-encrypts the stored attachments of a note under a new key.
+// With an unchanged key it only moves attachments still stored in the database to
+// the blob store, which needs the key for those of locked notes.
+func rekeyNoteDocuments(tx *gorm.DB, batch *blobBatch, noteID, userID uint, oldKey, newKey []byte) error {
+	if noteID == 0 {
+		return nil
+	}
+
+	query := tx.Scopes(ownedBy(userID)).Where("note_id = ?", noteID)
+	if bytes.Equal(oldKey, newKey) {
+		query = query.Where("blob_key = ''")
+	}
+
+	var documents []models.Document
+	if err := query.Find(&documents).Error; err != nil {
+		return fmt.Errorf("failed to fetch documents: %w", err)
+	}
+
+	for i := range documents {
+		if err := rekeyDocument(tx, batch, &documents[i], oldKey, newKey); err != nil {
+			return fmt.Errorf("failed to re-encrypt document %d: %w", documents[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+// rekeyDocument writes an attachment's content to a new blob encrypted with newKey
+func rekeyDocument(tx *gorm.DB, batch *blobBatch, document *models.Document, oldKey, newKey []byte) error {
+	open := func() (*blobReader, error) { return openDocument(*document, oldKey) }
+	blobKey, size, err := batch.rewrite(document.BlobKey, open, newKey)
+	if err != nil {
+		return err
+	}
+
+	batch.drop(document.BlobKey)
+	document.BlobKey = blobKey
+	document.Size = size
+	document.Encrypted = newKey != nil
+	document.Data = nil
+
+	return tx.Model(document).Select("blob_key", "size", "encrypted", "data").Updates(document).Error
+}
+
+// requireNoteAccess rejects changes to a locked note that was not unlocked first and
+// returns the note's key, nil for an unlocked note
+func requireNoteAccess(note models.Note, userID uint) ([]byte, error) {
+	if !note.IsLocked() {
+		return nil, nil
+	}
+
+	key, ok := noteAccessKey(userID, note.ID)
+	if !ok {
+		return nil, jsonError(http.StatusForbidden, "Note is locked")
+	}
+	return key, nil
+}
+
+// requireDocumentAccess rejects downloads of attachments that belong to a locked note
+func requireDocumentAccess(document models.Document, userID uint) ([]byte, error) {
+	if document.NoteId == 0 {
+		return nil, nil // Background pictures are shown on the locked note's card
+	}
+
+	var note models.Note
+	if err := DB.Select("id", "password").Scopes(ownedBy(userID)).First(&note, document.NoteId).Error; err != nil {
+		return nil, jsonError(http.StatusNotFound, "Document not found")
+	}
+
+	return requireNoteAccess(note, userID)
+}
+
+func grantNoteAccess(userID, noteID uint, key []byte) {
+	noteGrants.Lock()
+	defer noteGrants.Unlock()
+	noteGrants.grants[noteGrantKey{userID, noteID}] = noteGrant{
+		Key:       key,
+		ExpiresAt: time.Now().Add(NoteUnlockTTL),
+	}
+}
+
+func noteAccessKey(userID, noteID uint) ([]byte, bool) {
+	noteGrants.Lock()
+	defer noteGrants.Unlock()
+
+	grantKey := noteGrantKey{userID, noteID}
+	grant, ok := noteGrants.grants[grantKey]
+	if ok && time.Now().After(grant.ExpiresAt) {
+		delete(noteGrants.grants, grantKey)
+		return nil, false
+	}
+	return grant.Key, ok
+}
+
+func revokeNoteAccess(noteID uint) {
+	noteGrants.Lock()
+	defer noteGrants.Unlock()
+
+	for grantKey := range noteGrants.grants {
+		if grantKey.NoteID == noteID {
+			delete(noteGrants.grants, grantKey)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"bytes"
+	"testing"
+	"yana-back/crypt"
+	"yana-back/models"
+)
+
+func TestApplyNotePassword(t *testing.T) {
+	hashedPassword, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, err := crypt.NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := crypt.DeriveKey("secret", salt)
+	locked := models.Note{Password: hashedPassword, KeySalt: salt}
+
+	password := func(value string) noteInput { return noteInput{Password: &value} }
+	removePassword := true
+
+	tests := []struct {
+		name       string
+		note       models.Note
+		key        []byte
+		input      noteInput
+		keepsKey   bool
+		wantLocked bool
+	}{
+		{"no password", models.Note{}, nil, noteInput{}, true, false},
+		{"password kept", locked, key, noteInput{}, true, true},
+		{"same password sent again", locked, key, password("secret"), true, true},
+		{"password changed", locked, key, password("other"), false, true},
+		{"password set", models.Note{}, nil, password("secret"), false, true},
+		{"legacy note without a key", models.Note{Password: hashedPassword}, nil, password("secret"), false, true},
+		{"password removed", locked, key, noteInput{RemovePassword: &removePassword}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			note := test.note
+			got, err := applyNotePassword(&note, test.input, test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if keptKey := bytes.Equal(got, test.key) && bytes.Equal(note.KeySalt, test.note.KeySalt); keptKey != test.keepsKey {
+				t.Errorf("kept the key and salt: %v, want %v", keptKey, test.keepsKey)
+			}
+			if note.IsLocked() != test.wantLocked {
+				t.Errorf("note locked: %v, want %v", note.IsLocked(), test.wantLocked)
+			}
+			if test.input.Password != nil && !bytes.Equal(got, crypt.DeriveKey(*test.input.Password, note.KeySalt)) {
+				t.Error("the key does not match the password")
+			}
+		})
+	}
+}
@@ -1,16 +1,16 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"mime"
 	"mime/multipart"
 	"net/http"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"yana-back/models"
+	"yana-back/vault"
 
 	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
@@ -33,59 +33,147 @@ var weekdayNames = map[string]string{
 	"6": "Saturday",
 }
 
-// SaveNoteHandler handles creation or update of a Note, including multiple documents and bPicture
+// SaveNoteHandler handles creation or update of a Note, including multiple documents and bPicture.
+// Fields missing from the form or JSON body are cleared, see PatchNoteHandler to keep them.
 func SaveNoteHandler(c echo.Context) error {
 	userID, err := parseUserID(c)
 	if err != nil {
 		return err
 	}
 
-	note, err := findOrCreateNote(c)
+	input, err := bindNoteInput(c)
 	if err != nil {
 		return err
 	}
 
-	updateNoteFields(&note, c, userID)
+	note, err := findOrCreateNote(input.ID, userID)
+	if err != nil {
+		return err
+	}
 
-	if err := handleDocuments(c, &note, userID); err != nil {
+	oldKey, err := requireNoteAccess(note, userID)
+	if err != nil {
 		return err
 	}
 
-	if err := handleBackgroundPicture(c, &note, userID); err != nil {
+	if err := checkNoteVersion(c, note, input); err != nil {
 		return err
 	}
 
-	if err := saveNoteWithDocuments(&note); err != nil {
+	updateNoteFields(&note, input, userID)
+
+	key, err := applyNotePassword(&note, input, oldKey)
+	if err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message": fmt.Sprintf("Note '%s' saved successfully", note.Title),
-		"note":    note,
-	})
+	replaced, err := replacedNoteStorage(c, note, userID)
+	if err != nil {
+		return err
+	}
+	if err := checkStorageQuota(c, userID, replaced, "documents", "bPicture"); err != nil {
+		return err
+	}
+
+	// Uploads are streamed to the blob store before anything is written to the
+	// database; blobs of a failed save are deleted again
+	var batch blobBatch
+	defer batch.finish()
+
+	documents, err := readDocuments(c, &batch, userID, key)
+	if err != nil {
+		return err
+	}
+
+	bPicture, err := readBackgroundPicture(c, &batch, userID)
+	if err != nil {
+		return err
+	}
+
+	return storeNote(c, &batch, &note, documents, bPicture, oldKey, key)
+}
+
+// PatchNoteHandler changes only the fields present in the request body
+func PatchNoteHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	note, oldKey, err := findAccessibleNote(c, userID)
+	if err != nil {
+		return err
+	}
+
+	input, err := bindNoteInput(c)
+	if err != nil {
+		return err
+	}
+
+	if err := checkNoteVersion(c, note, input); err != nil {
+		return err
+	}
+
+	// Untouched fields are written back, so they must be in plaintext first
+	if err := openNote(&note, oldKey); err != nil {
+		log.Printf("Failed to decrypt note: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decrypt note"})
+	}
+
+	patchNoteFields(&note, input)
+
+	key, err := applyNotePassword(&note, input, oldKey)
+	if err != nil {
+		return err
+	}
+
+	var batch blobBatch
+	defer batch.finish()
+
+	return storeNote(c, &batch, &note, nil, nil, oldKey, key)
 }
 
 // GetNoteHandler handles fetching a note by ID
 func GetNoteHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
 	noteID, err := parseNoteID(c)
 	if err != nil {
 		return err
 	}
 
 	var note models.Note
-	if err := DB.Preload("Documents").First(&note, noteID).Error; err != nil {
+	if err := DB.Scopes(ownedBy(userID)).Preload("Documents", byPosition).First(&note, noteID).Error; err != nil {
 		return handleDBError(c, err, "Note not found", "Failed to fetch note")
 	}
 
-	response := buildNoteResponse(note)
+	response := buildNoteResponse(note, false)
+	setNoteETag(c, note)
 	return c.JSON(http.StatusOK, response)
 }
 
 // GetFilteredNotesHandler handles fetching notes based on keyword, filter, and pagination
 func GetFilteredNotesHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
 	params := parseFilterParams(c)
 
-	query := buildFilterQuery(params)
+	// Vault columns are encrypted, so the keyword can only be matched after decryption
+	if vault.Enabled() && params.Keyword != "" {
+		notes, totalRecords, err := searchNotesInMemory(params, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch notes"})
+		}
+		return c.JSON(http.StatusOK, buildPaginatedResponse(params.Page, params.Size, totalRecords, buildNotesResponse(notes)))
+	}
+
+	query := buildFilterQuery(params, userID)
 
 	var totalRecords int64
 	query.Model(&models.Note{}).Count(&totalRecords)
@@ -105,6 +193,11 @@ func GetFilteredNotesHandler(c echo.Context) error {
 
 // GetNotesCountByWeekdayHandler returns a JSON with the count of notes created for each weekday
 func GetNotesCountByWeekdayHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
 	type WeekdayNoteCount struct {
 		Weekday string `json:"weekday"`
 		Count   int    `json:"count"`
@@ -114,11 +207,12 @@ func GetNotesCountByWeekdayHandler(c echo.Context) error {
 	query := `
 		SELECT strftime('%w', created_at) AS weekday, COUNT(*) AS count
 		FROM notes
-		WHERE date(created_at) >= date('now', 'weekday 0', '-6 days')
+		WHERE user_id = ? AND deleted_at IS NULL
+		AND date(created_at) >= date('now', 'weekday 0', '-6 days')
 		AND date(created_at) <= date('now', 'weekday 0')
 		GROUP BY weekday`
 
-	if err := DB.Raw(query).Scan(&results).Error; err != nil {
+	if err := DB.Raw(query, userID).Scan(&results).Error; err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch notes count by weekday"})
 	}
 
@@ -145,23 +239,41 @@ func GetNotesCountByWeekdayHandler(c echo.Context) error {
 
 // GetNotesCountByMoodHandler returns a JSON with the count of notes grouped by mood, limited to top 7
 func GetNotesCountByMoodHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
 	type MoodNoteCount struct {
 		Mood  string `json:"mood"`
 		Count int    `json:"count"`
 	}
 
-	var results []MoodNoteCount
-	query := `
-		SELECT mood, COUNT(*) AS count
-		FROM notes
-		GROUP BY mood
-		ORDER BY count DESC
-		LIMIT ?`
-
-	if err := DB.Raw(query, MaxMoodResults).Scan(&results).Error; err != nil {
+	// Moods are counted in Go because vault mode encrypts the mood column
+	var notes []models.Note
+	if err := DB.Scopes(ownedBy(userID)).Select("mood").Find(&notes).Error; err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch notes count by mood"})
 	}
 
+	counts := make(map[string]int)
+	for _, note := range notes {
+		counts[note.Mood]++
+	}
+
+	var results []MoodNoteCount
+	for mood, count := range counts {
+		results = append(results, MoodNoteCount{Mood: mood, Count: count})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].Mood < results[j].Mood
+	})
+	if len(results) > MaxMoodResults {
+		results = results[:MaxMoodResults]
+	}
+
 	response := make(map[string]int)
 	for _, result := range results {
 		response[result.Mood] = result.Count
@@ -170,215 +282,429 @@ func GetNotesCountByMoodHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
-// DeleteNoteHandler handles the deletion of a note by ID, including all its documents
+// DeleteNoteHandler moves a note to the trash; its documents stay until the trash is
+// emptied
 func DeleteNoteHandler(c echo.Context) error {
-	noteID, err := parseNoteID(c)
+	userID, err := parseUserID(c)
 	if err != nil {
 		return err
 	}
 
-	var note models.Note
-	if err := DB.Preload("Documents").First(&note, noteID).Error; err != nil {
-		return handleDBError(c, err, "Note not found", "Failed to fetch note")
-	}
-
-	if err := deleteNoteDocuments(note.Documents); err != nil {
+	noteID, err := parseNoteID(c)
+	if err != nil {
 		return err
 	}
 
-	if err := DB.Delete(&note).Error; err != nil {
-		log.Printf("Failed to delete note: %v", err)
+	result := DB.Scopes(ownedBy(userID)).Delete(&models.Note{}, noteID)
+	if result.Error != nil {
+		log.Printf("Failed to delete note: %v", result.Error)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete note"})
 	}
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Note not found"})
+	}
+	revokeNoteAccess(noteID)
 
 	return c.JSON(http.StatusOK, map[string]string{
-		"message": fmt.Sprintf("Note with ID %d and all its documents deleted successfully", noteID),
+		"message": fmt.Sprintf("Note with ID %d moved to the trash", noteID),
 	})
 }
 
 // Helper functions
 
+// parseUserID returns the user ID carried by the request's session token
 func parseUserID(c echo.Context) (uint, error) {
-	userIDStr := c.FormValue("user_id")
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		return 0, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	userID := sessionUserID(c)
+	if userID == 0 {
+		return 0, jsonError(http.StatusUnauthorized, "Authentication required")
 	}
-	return uint(userID), nil
+	return userID, nil
 }
 
-func parseNoteID(c echo.Context) (int, error) {
+func parseNoteID(c echo.Context) (uint, error) {
 	noteIDStr := c.Param("id")
-	noteID, err := strconv.Atoi(noteIDStr)
+	noteID, err := strconv.ParseUint(noteIDStr, 10, 64)
 	if err != nil {
 		return 0, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid note ID"})
 	}
-	return noteID, nil
+	return uint(noteID), nil
 }
 
-func findOrCreateNote(c echo.Context) (models.Note, error) {
-	noteIDStr := c.FormValue("id")
-	if noteIDStr == "" {
-		return models.Note{}, nil
+// noteInput holds the editable fields of a note as sent in a form or JSON body; nil
+// fields were not sent
+type noteInput struct {
+	ID             *int    `json:"id"`
+	Title          *string `json:"title"`
+	Content        *string `json:"content"`
+	Tag            *string `json:"tag"`
+	Mood           *string `json:"mood"`
+	FColor         *string `json:"fColor"`
+	BColor         *string `json:"bColor"`
+	Version        *int    `json:"version"`
+	Password       *string `json:"password"`
+	RemovePassword *bool   `json:"remove_password"`
+	EncryptTitle   *bool   `json:"encrypt_title"`
+}
+
+func bindNoteInput(c echo.Context) (noteInput, error) {
+	var input noteInput
+	if isJSONRequest(c) {
+		err := bindJSON(c, &input)
+		return input, err
 	}
 
-	noteID, err := strconv.Atoi(noteIDStr)
+	id, err := formInt(c, "id")
 	if err != nil {
-		return models.Note{}, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid note ID"})
+		return input, jsonError(http.StatusBadRequest, "Invalid note ID")
+	}
+
+	version, err := formInt(c, "version")
+	if err != nil {
+		return input, jsonError(http.StatusBadRequest, "Invalid note version")
+	}
+
+	input.ID = id
+	input.Version = version
+	input.Title = formString(c, "title")
+	input.Content = formString(c, "content")
+	input.Tag = formString(c, "tag")
+	input.Mood = formString(c, "mood")
+	input.FColor = formString(c, "fColor")
+	input.BColor = formString(c, "bColor")
+	input.Password = formString(c, "password")
+	input.RemovePassword = formBool(c, "remove_password")
+	input.EncryptTitle = formBool(c, "encrypt_title")
+	return input, nil
+}
+
+func findOrCreateNote(noteID *int, userID uint) (models.Note, error) {
+	if noteID == nil {
+		return models.Note{}, nil
 	}
 
 	var note models.Note
-	if err := DB.First(&note, noteID).Error; err != nil {
+	if err := DB.Scopes(ownedBy(userID)).First(&note, *noteID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return models.Note{}, c.JSON(http.StatusNotFound, map[string]string{"error": "Note not found"})
+			return models.Note{}, jsonError(http.StatusNotFound, "Note not found")
 		}
-		return models.Note{}, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch note"})
+		return models.Note{}, jsonError(http.StatusInternalServerError, "Failed to fetch note")
 	}
 
 	return note, nil
 }
 
-func updateNoteFields(note *models.Note, c echo.Context, userID uint) {
+// updateNoteFields replaces every field, clearing those that were not sent
+func updateNoteFields(note *models.Note, input noteInput, userID uint) {
 	note.UserId = userID
-	note.Title = c.FormValue("title")
-	note.Content = c.FormValue("content")
-	note.Tag = c.FormValue("tag")
-	note.Mood = c.FormValue("mood")
-	note.FColor = c.FormValue("fColor")
-	note.BColor = c.FormValue("bColor")
-	note.Password = c.FormValue("password")
+	note.Title = stringValue(input.Title)
+	note.Content = stringValue(input.Content)
+	note.Tag = stringValue(input.Tag)
+	note.Mood = stringValue(input.Mood)
+	note.FColor = stringValue(input.FColor)
+	note.BColor = stringValue(input.BColor)
+}
+
+// patchNoteFields replaces only the fields that were sent
+func patchNoteFields(note *models.Note, input noteInput) {
+	setIfPresent(&note.Title, input.Title)
+	setIfPresent(&note.Content, input.Content)
+	setIfPresent(&note.Tag, input.Tag)
+	setIfPresent(&note.Mood, input.Mood)
+	setIfPresent(&note.FColor, input.FColor)
+	setIfPresent(&note.BColor, input.BColor)
+}
+
+// storeNote encrypts and saves a note with its new attachments and background picture
+// in one transaction, then answers with the saved note
+func storeNote(c echo.Context, batch *blobBatch, note *models.Note, documents []models.Document, bPicture *models.Document, oldKey, key []byte) error {
+	if err := sealNote(note, key); err != nil {
+		log.Printf("Failed to encrypt note: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to encrypt note"})
+	}
+
+	// A failing step rolls back the whole save, so the note is never left half-written
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := bumpNoteVersion(tx, note); err != nil {
+			return err
+		}
+		if err := updateDocuments(tx, batch, note, documents, note.UserId, oldKey, key); err != nil {
+			return err
+		}
+		if err := rekeyNoteRevisions(tx, batch, note.ID, oldKey, key); err != nil {
+			log.Printf("Failed to re-encrypt revisions: %v", err)
+			return jsonError(http.StatusInternalServerError, "Failed to re-encrypt revisions")
+		}
+		if err := replaceBackgroundPicture(tx, batch, note, bPicture, note.UserId); err != nil {
+			return err
+		}
+		if err := saveNoteWithDocuments(tx, note); err != nil {
+			return err
+		}
+		if err := recordNoteRevision(tx, batch, note, key); err != nil {
+			log.Printf("Failed to record revision: %v", err)
+			return jsonError(http.StatusInternalServerError, "Failed to record revision")
+		}
+		if len(documents) > 0 || bPicture != nil {
+			if err := recheckStorageQuota(tx, note.UserId); err != nil {
+				return err
+			}
+		}
+		if err := batch.commit(tx); err != nil {
+			log.Printf("Failed to count blob references: %v", err)
+			return jsonError(http.StatusInternalServerError, "Failed to save documents")
+		}
+		return loadDocumentIDs(tx, note, note.UserId)
+	})
+	if errors.Is(err, errVersionConflict) {
+		return noteConflict(c, note.ID, note.UserId)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := openNote(note, key); err != nil {
+		log.Printf("Failed to decrypt note: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decrypt note"})
+	}
+
+	// The client just proved it knows the password, keep the note open for it
+	if note.IsLocked() {
+		grantNoteAccess(note.UserId, note.ID, key)
+	}
+
+	setNoteETag(c, *note)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("Note '%s' saved successfully", note.Title),
+		"note":    buildNoteResponse(*note, true),
+	})
 }
 
-func handleDocuments(c echo.Context, note *models.Note, userID uint) error {
+// readDocuments streams the uploaded attachments into the blob store, encrypted
+// under the note's key
+func readDocuments(c echo.Context, batch *blobBatch, userID uint, key []byte) ([]models.Document, error) {
+	if !isMultipartRequest(c) {
+		return nil, nil // Only multipart forms carry files
+	}
+
 	form, err := c.MultipartForm()
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid multipart form"})
+		if sizeErr := requestSizeError(err); sizeErr != nil {
+			return nil, sizeErr
+		}
+		return nil, jsonError(http.StatusBadRequest, "Invalid multipart form")
 	}
 
-	files := form.File["documents"]
 	var documents []models.Document
-
-	for _, fileHeader := range files {
-		document, err := createDocumentFromFile(fileHeader, userID, uint(note.ID))
+	for _, fileHeader := range form.File["documents"] {
+		document, err := createDocumentFromFile(fileHeader, batch, userID, 0, key, false)
+		if isHTTPError(err) {
+			return nil, err
+		}
 		if err != nil {
-			return err
+			log.Printf("Failed to store document: %v", err)
+			return nil, jsonError(http.StatusInternalServerError, fmt.Sprintf("Failed to store document '%s'", fileHeader.Filename))
 		}
 		documents = append(documents, document)
 	}
 
-	// Delete existing documents before adding new ones
-	DB.Where("note_id = ?", note.ID).Delete(&models.Document{})
+	return documents, nil
+}
+
+// replacedNoteStorage sums the sizes of the stored files the uploads of a save replace:
+// all attachments when new ones were sent, and the background picture
+func replacedNoteStorage(c echo.Context, note models.Note, userID uint) (int64, error) {
+	if note.ID == 0 || Uploads.UserQuota <= 0 {
+		return 0, nil
+	}
+
+	var replaced int64
+	if uploadedSize(c, "documents") > 0 {
+		size, err := documentsSize(DB.Scopes(ownedBy(userID)).Where("note_id = ?", note.ID))
+		if err != nil {
+			log.Printf("Failed to compute replaced storage: %v", err)
+			return 0, jsonError(http.StatusInternalServerError, "Failed to check storage quota")
+		}
+		replaced += size
+	}
+
+	if note.BPictureId != nil && uploadedSize(c, "bPicture") > 0 {
+		size, err := documentsSize(DB.Scopes(ownedBy(userID)).Where("id = ?", *note.BPictureId))
+		if err != nil {
+			log.Printf("Failed to compute replaced storage: %v", err)
+			return 0, jsonError(http.StatusInternalServerError, "Failed to check storage quota")
+		}
+		replaced += size
+	}
+
+	return replaced, nil
+}
+
+// updateDocuments replaces the note's stored attachments with documents unless it is
+// nil, when the stored ones are kept and re-encrypted if the note's key changed
+func updateDocuments(tx *gorm.DB, batch *blobBatch, note *models.Note, documents []models.Document, userID uint, oldKey, newKey []byte) error {
+	if documents == nil {
+		if err := rekeyNoteDocuments(tx, batch, note.ID, userID, oldKey, newKey); err != nil {
+			log.Printf("Failed to re-encrypt documents: %v", err)
+			return jsonError(http.StatusInternalServerError, "Failed to re-encrypt documents")
+		}
+		return nil
+	}
+
+	if note.ID != 0 {
+		if err := deleteDocuments(batch, tx.Scopes(ownedBy(userID)).Where("note_id = ?", note.ID)); err != nil {
+			log.Printf("Failed to delete documents: %v", err)
+			return jsonError(http.StatusInternalServerError, "Failed to delete old documents")
+		}
+	}
+
+	for i := range documents {
+		documents[i].Position = i
+	}
 	note.Documents = documents
+	return nil
+}
+
+// loadDocumentIDs fills in the attachments a save kept, for the response
+func loadDocumentIDs(tx *gorm.DB, note *models.Note, userID uint) error {
+	if len(note.Documents) > 0 {
+		return nil
+	}
 
+	if err := tx.Scopes(ownedBy(userID), byPosition).Select("id").Where("note_id = ?", note.ID).Find(&note.Documents).Error; err != nil {
+		log.Printf("Failed to fetch documents: %v", err)
+		return jsonError(http.StatusInternalServerError, "Failed to fetch documents")
+	}
 	return nil
 }
 
-func createDocumentFromFile(fileHeader *multipart.FileHeader, userID uint, noteID uint) (models.Document, error) {
-	file, err := fileHeader.Open()
+// createDocumentFromFile streams an uploaded file into the blob store, encrypted with
+// key if set. Files over the upload limits are rejected with an HTTP error.
+func createDocumentFromFile(fileHeader *multipart.FileHeader, batch *blobBatch, userID, noteID uint, key []byte, imagesOnly bool) (models.Document, error) {
+	file, err := openUpload(fileHeader, imagesOnly)
 	if err != nil {
-		return models.Document{}, fmt.Errorf("failed to open file: %w", err)
+		return models.Document{}, err
 	}
 	defer file.Close()
 
-	fileData, err := io.ReadAll(file)
+	contentType := file.contentType
+
+	blobKey, size, err := batch.write(file, key)
 	if err != nil {
-		return models.Document{}, fmt.Errorf("failed to read file: %w", err)
+		return models.Document{}, fmt.Errorf("failed to store file: %w", err)
 	}
 
-	contentType := determineContentType(fileHeader, fileData)
-
 	return models.Document{
-		UserId: userID,
-		NoteId: int(noteID),
-		Name:   fileHeader.Filename,
-		Data:   fileData,
-		Type:   &contentType,
+		UserId:    userID,
+		NoteId:    noteID,
+		Name:      fileHeader.Filename,
+		Type:      &contentType,
+		BlobKey:   blobKey,
+		Size:      size,
+		Encrypted: key != nil,
 	}, nil
 }
 
-func handleBackgroundPicture(c echo.Context, note *models.Note, userID uint) error {
+// readBackgroundPicture reads the uploaded background picture, nil when none was sent
+func readBackgroundPicture(c echo.Context, batch *blobBatch, userID uint) (*models.Document, error) {
 	bPictureHeader, err := c.FormFile("bPicture")
 	if err != nil {
-		return nil // No background picture provided
+		return nil, requestSizeError(err) // Otherwise no background picture provided
 	}
 
-	document, err := createDocumentFromFile(bPictureHeader, userID, 0)
+	document, err := createDocumentFromFile(bPictureHeader, batch, userID, 0, nil, true)
+	if isHTTPError(err) {
+		return nil, err
+	}
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to process bPicture file"})
+		log.Printf("Failed to read bpicture: %v", err)
+		return nil, jsonError(http.StatusBadRequest, "Failed to process bPicture file")
 	}
 
-	document.NoteId = -1
+	return &document, nil // Background pictures keep note ID 0
+}
 
-	if err := DB.Save(&document).Error; err != nil {
+// replaceBackgroundPicture stores a new background picture and deletes the old one
+func replaceBackgroundPicture(tx *gorm.DB, batch *blobBatch, note *models.Note, document *models.Document, userID uint) error {
+	if document == nil {
+		return nil
+	}
+
+	if err := tx.Save(document).Error; err != nil {
 		log.Printf("Failed to save bpicture: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save bpicture"})
+		return jsonError(http.StatusInternalServerError, "Failed to save bpicture")
 	}
 
 	// Delete old background picture if it exists
 	if note.BPictureId != nil {
-		DB.Delete(&models.Document{}, note.BPictureId)
+		if err := deleteDocuments(batch, tx.Scopes(ownedBy(userID)).Where("id = ?", *note.BPictureId)); err != nil {
+			log.Printf("Failed to delete bpicture: %v", err)
+			return jsonError(http.StatusInternalServerError, "Failed to delete old bpicture")
+		}
 	}
 
-	note.BPicture = &document
+	note.BPicture = document
+	note.BPictureId = &document.ID
 	return nil
 }
 
-func determineContentType(fileHeader *multipart.FileHeader, fileData []byte) string {
-	contentType := fileHeader.Header.Get("Content-Type")
-	if contentType != "" {
-		return contentType
-	}
-
-	contentType = mime.TypeByExtension(filepath.Ext(fileHeader.Filename))
-	if contentType != "" {
-		return contentType
-	}
-
-	return http.DetectContentType(fileData)
-}
-
-func saveNoteWithDocuments(note *models.Note) error {
-	if err := DB.Save(note).Error; err != nil {
+func saveNoteWithDocuments(tx *gorm.DB, note *models.Note) error {
+	if err := tx.Save(note).Error; err != nil {
 		log.Printf("Failed to save note: %v", err)
-		return fmt.Errorf("failed to save note: %w", err)
+		return jsonError(http.StatusInternalServerError, "Failed to save note")
 	}
 
 	for i := range note.Documents {
 		note.Documents[i].NoteId = note.ID
-		if err := DB.Save(&note.Documents[i]).Error; err != nil {
+		if err := tx.Save(&note.Documents[i]).Error; err != nil {
 			log.Printf("Failed to save document: %v", err)
-			return fmt.Errorf("failed to save documents: %w", err)
+			return jsonError(http.StatusInternalServerError, "Failed to save documents")
 		}
 	}
 
 	return nil
 }
 
-func buildNoteResponse(note models.Note) map[string]interface{} {
+// buildNoteResponse describes a note; the content and attachments of a locked note
+// are only included once it has been unlocked
+func buildNoteResponse(note models.Note, unlocked bool) map[string]interface{} {
 	response := map[string]interface{}{
-		"id":       note.ID,
-		"title":    note.Title,
-		"content":  note.Content,
-		"tag":      note.Tag,
-		"mood":     note.Mood,
-		"fColor":   note.FColor,
-		"bColor":   note.BColor,
-		"password": note.Password,
+		"id":      note.ID,
+		"title":   visibleTitle(note, unlocked),
+		"tag":     note.Tag,
+		"mood":    note.Mood,
+		"fColor":  note.FColor,
+		"bColor":  note.BColor,
+		"locked":  note.IsLocked(),
+		"version": note.Version,
 	}
 
+	if note.BPictureId != nil {
+		response["bPicture"] = *note.BPictureId
+	}
+
+	if note.IsLocked() && !unlocked {
+		return response
+	}
+
+	response["content"] = note.Content
+
 	var documentIDs []uint
 	for _, doc := range note.Documents {
 		documentIDs = append(documentIDs, doc.ID)
 	}
 	response["documents"] = documentIDs
 
-	if note.BPictureId != nil {
-		response["bPicture"] = *note.BPictureId
-	}
-
 	return response
 }
 
+// visibleTitle hides the title of a locked note while its title is still encrypted
+func visibleTitle(note models.Note, unlocked bool) string {
+	if note.TitleEncrypted && !unlocked {
+		return ""
+	}
+	return note.Title
+}
+
 type FilterParams struct {
 	Keyword string
 	Filter  string
@@ -405,8 +731,8 @@ func parseFilterParams(c echo.Context) FilterParams {
 	}
 }
 
-func buildFilterQuery(params FilterParams) *gorm.DB {
-	query := DB.Preload("Documents")
+func buildFilterQuery(params FilterParams, userID uint) *gorm.DB {
+	query := DB.Scopes(ownedBy(userID)).Preload("Documents")
 
 	if params.Keyword == "" {
 		return query
@@ -415,29 +741,88 @@ func buildFilterQuery(params FilterParams) *gorm.DB {
 	var conditions []string
 	var args []interface{}
 
-	if params.Filter != "" {
-		fields := strings.Split(params.Filter, ",")
+	for _, field := range searchFields(params.Filter) {
+		conditions = append(conditions, searchCondition(field))
+		args = append(args, "%"+params.Keyword+"%")
+	}
+
+	if len(conditions) > 0 {
+		query = query.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+
+	return query
+}
+
+// searchFields lists the fields named by the filter parameter, or all of them
+func searchFields(filter string) []string {
+	if filter == "" {
+		// Search in all relevant fields
+		return []string{"title", "mood", "tag", "content"}
+	}
+
+	var fields []string
+	for _, field := range strings.Split(filter, ",") {
+		field = strings.TrimSpace(field)
+		if isValidSearchField(field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// searchNotesInMemory filters and paginates a user's notes in Go, for vaults whose
+// columns cannot be matched by SQL
+func searchNotesInMemory(params FilterParams, userID uint) ([]models.Note, int64, error) {
+	var notes []models.Note
+	if err := DB.Scopes(ownedBy(userID)).Order("created_at DESC").Find(&notes).Error; err != nil {
+		return nil, 0, err
+	}
+
+	fields := searchFields(params.Filter)
+	keyword := strings.ToLower(params.Keyword)
+
+	var matches []models.Note
+	for _, note := range notes {
 		for _, field := range fields {
-			field = strings.TrimSpace(field)
-			if isValidSearchField(field) {
-				conditions = append(conditions, field+" LIKE ?")
-				args = append(args, "%"+params.Keyword+"%")
+			if strings.Contains(strings.ToLower(searchableValue(note, field)), keyword) {
+				matches = append(matches, note)
+				break
 			}
 		}
-	} else {
-		// Search in all relevant fields
-		searchFields := []string{"title", "mood", "tag", "content"}
-		for _, field := range searchFields {
-			conditions = append(conditions, field+" LIKE ?")
-			args = append(args, "%"+params.Keyword+"%")
-		}
 	}
 
-	if len(conditions) > 0 {
-		query = query.Where(strings.Join(conditions, " OR "), args...)
+	offset := min((params.Page-1)*params.Size, len(matches))
+	end := min(offset+params.Size, len(matches))
+	return matches[offset:end], int64(len(matches)), nil
+}
+
+// searchableValue mirrors searchCondition for in-memory search
+func searchableValue(note models.Note, field string) string {
+	switch field {
+	case "title":
+		return visibleTitle(note, false)
+	case "mood":
+		return note.Mood
+	case "tag":
+		return note.Tag
+	case "content":
+		if !note.IsLocked() {
+			return note.Content
+		}
 	}
+	return ""
+}
 
-	return query
+// searchCondition matches a field, never looking inside the encrypted content or
+// title of locked notes
+func searchCondition(field string) string {
+	switch field {
+	case "content":
+		return "(password = '' AND content LIKE ?)"
+	case "title":
+		return "(title_encrypted = 0 AND title LIKE ?)"
+	}
+	return field + " LIKE ?"
 }
 
 func isValidSearchField(field string) bool {
@@ -455,16 +840,18 @@ func buildNotesResponse(notes []models.Note) []map[string]interface{} {
 	for _, note := range notes {
 		noteResponse := map[string]interface{}{
 			"id":         note.ID,
-			"title":      note.Title,
-			"content":    note.Content,
+			"title":      visibleTitle(note, false),
 			"tag":        note.Tag,
 			"mood":       note.Mood,
 			"fcolor":     note.FColor,
 			"bcolor":     note.BColor,
-			"password":   note.Password,
+			"locked":     note.IsLocked(),
 			"bPictureId": note.BPictureId,
 			"createdAt":  note.CreatedAt,
 		}
+		if !note.IsLocked() {
+			noteResponse["content"] = note.Content
+		}
 		noteResponses = append(noteResponses, noteResponse)
 	}
 	return noteResponses
@@ -479,13 +866,18 @@ func buildPaginatedResponse(page, size int, totalRecords int64, notes []map[stri
 	}
 }
 
-func deleteNoteDocuments(documents []models.Document) error {
-	for _, doc := range documents {
-		if err := DB.Delete(&doc).Error; err != nil {
-			log.Printf("Failed to delete document: %v", err)
-			return fmt.Errorf("failed to delete documents: %w", err)
-		}
+// deleteDocuments deletes the documents matched by query and drops their blobs
+func deleteDocuments(batch *blobBatch, query *gorm.DB) error {
+	var blobKeys []string
+	if err := query.Session(&gorm.Session{}).Model(&models.Document{}).Pluck("blob_key", &blobKeys).Error; err != nil {
+		return err
 	}
+
+	if err := query.Session(&gorm.Session{}).Delete(&models.Document{}).Error; err != nil {
+		return err
+	}
+
+	batch.drop(blobKeys...)
 	return nil
 }
 
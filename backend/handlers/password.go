@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	RecoveryCodeCount  = 10
+	RecoveryCodeLength = 10
+
+	// Unambiguous characters, so codes survive being written down by hand
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// ChangePasswordHandler replaces the logged-in user's password after checking the current one.
+// The user's other sessions end, the response carries a new token for this one.
+func ChangePasswordHandler(c echo.Context) error {
+	user, err := findSessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	if !user.HasPassword {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "No password is set, set a first password instead"})
+	}
+
+	if err := verifyCurrentPassword(c, user); err != nil {
+		return err
+	}
+
+	newPassword := c.FormValue("new_password")
+	if newPassword == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "New password is required"})
+	}
+
+	return respondWithNewPassword(c, user, newPassword)
+}
+
+// SetPasswordHandler sets the first password of a user that has none. The sessions
+// opened without it end, the response carries a new token for this one.
+func SetPasswordHandler(c echo.Context) error {
+	user, err := findSessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	if user.HasPassword {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A password is already set, change it instead"})
+	}
+
+	newPassword := c.FormValue("new_password")
+	if newPassword == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "New password is required"})
+	}
+
+	return respondWithNewPassword(c, user, newPassword)
+}
+
+// RemovePasswordHandler removes the logged-in user's password after checking it. The
+// user's other sessions end, the response carries a new token for this one.
+func RemovePasswordHandler(c echo.Context) error {
+	user, err := findSessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	if !user.HasPassword {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "No password is set"})
+	}
+
+	if err := verifyCurrentPassword(c, user); err != nil {
+		return err
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).UpdateColumn("password", "").Error; err != nil {
+			return err
+		}
+		if err := endSessions(tx, &user); err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		log.Printf("Failed to remove password: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove password"})
+	}
+	user.Password = ""
+	user.HasPassword = false
+
+	response, err := sessionResponse(user)
+	if err != nil {
+		log.Printf("Failed to issue session token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create session"})
+	}
+	response["message"] = "Password removed"
+	return c.JSON(http.StatusOK, response)
+}
+
+// RecoverPasswordHandler resets a forgotten password with a one-time recovery code,
+// ending the user's other sessions, and logs the user in
+func RecoverPasswordHandler(c echo.Context) error {
+	userID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var user models.User
+	if err := DB.First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid recovery code"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch user"})
+	}
+
+	release, err := checkThrottle(c, ThrottleScopeUser, user.ID, user.Hint)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	newPassword := c.FormValue("new_password")
+	if newPassword == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "New password is required"})
+	}
+
+	code, err := findRecoveryCode(user.ID, c.FormValue("recovery_code"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check recovery code"})
+	}
+	if code == nil {
+		recordFailedAttempt(c, ThrottleScopeUser, user.ID)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid recovery code"})
+	}
+	recordSuccessfulAttempt(c, ThrottleScopeUser, user.ID)
+
+	codes, err := setUserPassword(&user, newPassword)
+	if err != nil {
+		log.Printf("Failed to reset password: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
+	}
+
+	return respondWithSession(c, user, codes)
+}
+
+// Helper functions
+
+func verifyCurrentPassword(c echo.Context, user models.User) error {
+	release, err := checkThrottle(c, ThrottleScopeUser, user.ID, user.Hint)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !checkPassword(user.Password, c.FormValue("current_password")) {
+		recordFailedAttempt(c, ThrottleScopeUser, user.ID)
+		return jsonError(http.StatusUnauthorized, "Current password is incorrect")
+	}
+
+	recordSuccessfulAttempt(c, ThrottleScopeUser, user.ID)
+	return nil
+}
+
+func respondWithNewPassword(c echo.Context, user models.User, password string) error {
+	codes, err := setUserPassword(&user, password)
+	if err != nil {
+		log.Printf("Failed to set password: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set password"})
+	}
+
+	response, err := sessionResponse(user)
+	if err != nil {
+		log.Printf("Failed to issue session token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create session"})
+	}
+	response["message"] = "Password saved, store the recovery codes somewhere safe"
+	response["recoveryCodes"] = codes
+	return c.JSON(http.StatusOK, response)
+}
+
+// setUserPassword stores a new password hash and replaces the user's recovery codes,
+// returning the new codes in plain text; they are never shown again
+func setUserPassword(user *models.User, password string) ([]string, error) {
+	newPassword, err := prepareNewPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := DB.Transaction(func(tx *gorm.DB) error { return newPassword.save(tx, user) }); err != nil {
+		return nil, fmt.Errorf("failed to save password: %w", err)
+	}
+	return newPassword.codes, nil
+}
+
+// newPassword is a password hash with fresh recovery codes, ready to be saved with
+// other changes to the user
+type newPassword struct {
+	hash  string
+	codes []string
+}
+
+func prepareNewPassword(password string) (newPassword, error) {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return newPassword{}, err
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return newPassword{}, err
+	}
+
+	return newPassword{hash: hashedPassword, codes: codes}, nil
+}
+
+// save stores the password hash and replaces the user's recovery codes in tx. The
+// sessions issued under the old password end.
+func (p newPassword) save(tx *gorm.DB, user *models.User) error {
+	if err := tx.Model(user).UpdateColumn("password", p.hash).Error; err != nil {
+		return err
+	}
+	if err := endSessions(tx, user); err != nil {
+		return err
+	}
+
+	if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+
+	for _, code := range p.codes {
+		codeHash, err := hashPassword(normalizeRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&models.RecoveryCode{UserId: user.ID, CodeHash: codeHash}).Error; err != nil {
+			return err
+		}
+	}
+
+	user.Password = p.hash
+	user.HasPassword = true
+	return nil
+}
+
+// findRecoveryCode marks the matching unused recovery code as used and returns it,
+// or nil when the code does not match
+func findRecoveryCode(userID uint, code string) (*models.RecoveryCode, error) {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return nil, nil
+	}
+
+	var codes []models.RecoveryCode
+	if err := DB.Where("user_id = ? AND used_at IS NULL", userID).Find(&codes).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range codes {
+		if bcrypt.CompareHashAndPassword([]byte(codes[i].CodeHash), []byte(code)) != nil {
+			continue
+		}
+
+		// Only one of concurrent requests redeems the code
+		now := time.Now()
+		result := DB.Model(&models.RecoveryCode{}).Where("id = ? AND used_at IS NULL", codes[i].ID).UpdateColumn("used_at", now)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, nil
+		}
+		codes[i].UsedAt = &now
+		return &codes[i], nil
+	}
+
+	return nil, nil
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	alphabetSize := big.NewInt(int64(len(recoveryCodeAlphabet)))
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		var code strings.Builder
+		for j := 0; j < RecoveryCodeLength; j++ {
+			if j == RecoveryCodeLength/2 {
+				code.WriteByte('-')
+			}
+			n, err := rand.Int(rand.Reader, alphabetSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+			}
+			code.WriteByte(recoveryCodeAlphabet[n.Int64()])
+		}
+		codes[i] = code.String()
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRecoverPassword(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "")
+	codes, err := setUserPassword(&user, "forgotten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), RecoveryCodeCount)
+	}
+
+	e := echo.New()
+	e.POST("/login", LoginHandler)
+	e.POST("/user/password/recover", RecoverPasswordHandler)
+	id := strconv.Itoa(int(user.ID))
+	recoverWith := func(code, password string) int {
+		rec := postForm(e, "/user/password/recover", url.Values{"id": {id}, "recovery_code": {code}, "new_password": {password}})
+		return rec.Code
+	}
+
+	if code := recoverWith("aaaaa-aaaaa", "guessed"); code != http.StatusUnauthorized {
+		t.Errorf("unknown code got status %d, want 401", code)
+	}
+
+	// Codes are accepted the way people type them
+	rec := postForm(e, "/user/password/recover", url.Values{
+		"id": {id}, "recovery_code": {" " + strings.ToUpper(codes[0])}, "new_password": {"remembered"},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("recovery got status %d, want 200", rec.Code)
+	}
+	var response struct {
+		Token         string   `json:"token"`
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Token == "" || len(response.RecoveryCodes) != RecoveryCodeCount {
+		t.Errorf("recovery returned %+v, want a session and new codes", response)
+	}
+
+	// The used code is spent, and so are the others issued with it
+	if code := recoverWith(codes[0], "stolen"); code != http.StatusUnauthorized {
+		t.Errorf("used code got status %d, want 401", code)
+	}
+	if code := recoverWith(codes[1], "stolen"); code != http.StatusUnauthorized {
+		t.Errorf("replaced code got status %d, want 401", code)
+	}
+
+	logins := []struct {
+		password string
+		want     int
+	}{
+		{"remembered", http.StatusOK},
+		{"forgotten", http.StatusUnauthorized},
+	}
+	for _, login := range logins {
+		rec := postForm(e, "/login", url.Values{"id": {id}, "password": {login.password}})
+		if rec.Code != login.want {
+			t.Errorf("login with %q got status %d, want %d", login.password, rec.Code, login.want)
+		}
+	}
+}
+
+func TestRecoveryCodeRedeemedOnce(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "")
+	codes, err := setUserPassword(&user, "forgotten")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.POST("/user/password/recover", RecoverPasswordHandler)
+
+	const attempts = 5
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := postForm(e, "/user/password/recover", url.Values{
+				"id": {strconv.Itoa(int(user.ID))}, "recovery_code": {codes[0]}, "new_password": {fmt.Sprintf("attacker %d", i)},
+			})
+			statuses <- rec.Code
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	redeemed := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			redeemed++
+		}
+	}
+	if redeemed != 1 {
+		t.Errorf("the code was redeemed %d times, want once", redeemed)
+	}
+}
+
+func TestChangePasswordEndsSessions(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "old")
+
+	e := echo.New()
+	e.Use(RequireSession)
+	e.POST("/login", LoginHandler)
+	e.POST("/user/password/change", ChangePasswordHandler)
+	e.GET("/user/password/check", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	var sessions [2]string
+	for i := range sessions {
+		rec := postForm(e, "/login", url.Values{"id": {strconv.Itoa(int(user.ID))}, "password": {"old"}})
+		sessions[i] = tokenOf(t, rec)
+	}
+
+	rec := postFormWithToken(e, "/user/password/change", url.Values{"current_password": {"old"}, "new_password": {"new"}}, sessions[0])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("password change got status %d, want 200", rec.Code)
+	}
+	renewed := tokenOf(t, rec)
+
+	for token, want := range map[string]int{sessions[0]: http.StatusUnauthorized, sessions[1]: http.StatusUnauthorized, renewed: http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/user/password/check", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("got status %d, want %d", rec.Code, want)
+		}
+	}
+}
+
+// tokenOf reads the session token from a response
+func tokenOf(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || response.Token == "" {
+		t.Fatalf("no session in response %s: %v", rec.Body, err)
+	}
+	return response.Token
+}
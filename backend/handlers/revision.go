@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"yana-back/crypt"
+	"yana-back/diff"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	// Revisions are thinned as they age: all of them are kept for RevisionKeepAll,
+	// then the last of each hour up to RevisionKeepHourly, then the last of each day
+	RevisionKeepAll    = time.Hour
+	RevisionKeepHourly = 24 * time.Hour
+)
+
+// GetNoteRevisionsHandler lists the revisions of a note, newest first
+func GetNoteRevisionsHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	note, key, err := findAccessibleNote(c, userID)
+	if err != nil {
+		return err
+	}
+
+	var revisions []models.NoteRevision
+	err = DB.Preload("Documents", byPosition).Where("note_id = ?", note.ID).Order("created_at DESC, id DESC").Find(&revisions).Error
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch revisions"})
+	}
+
+	responses := make([]map[string]interface{}, 0, len(revisions))
+	for _, revision := range revisions {
+		if err := openRevision(&revision, key); err != nil {
+			log.Printf("Failed to decrypt revision %d: %v", revision.ID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decrypt revision"})
+		}
+		responses = append(responses, map[string]interface{}{
+			"id":        revision.ID,
+			"version":   revision.Version,
+			"title":     revision.Title,
+			"documents": len(revision.Documents),
+			"createdAt": revision.CreatedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"revisions": responses})
+}
+
+// GetNoteRevisionHandler returns a revision with its content and attachment list
+func GetNoteRevisionHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	note, key, err := findAccessibleNote(c, userID)
+	if err != nil {
+		return err
+	}
+
+	revision, err := findRevision(note.ID, c.Param("revision"), key)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, revision)
+}
+
+// GetNoteRevisionDiffHandler compares two revisions of a note line by line, ?from= and
+// ?to= name them; to defaults to the latest revision
+func GetNoteRevisionDiffHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	note, key, err := findAccessibleNote(c, userID)
+	if err != nil {
+		return err
+	}
+
+	from, err := findRevision(note.ID, c.QueryParam("from"), key)
+	if err != nil {
+		return err
+	}
+
+	toID := c.QueryParam("to")
+	if toID == "" {
+		var latest models.NoteRevision
+		if err := DB.Select("id").Where("note_id = ?", note.ID).Order("created_at DESC, id DESC").First(&latest).Error; err != nil {
+			return handleDBError(c, err, "Revision not found", "Failed to fetch revision")
+		}
+		toID = strconv.FormatUint(uint64(latest.ID), 10)
+	}
+
+	to, err := findRevision(note.ID, toID, key)
+	if err != nil {
+		return err
+	}
+
+	response := map[string]interface{}{
+		"from":    revisionSummary(from),
+		"to":      revisionSummary(to),
+		"title":   diff.Lines(from.Title, to.Title),
+		"content": diff.Lines(from.Content, to.Content),
+	}
+	if from.Tag != to.Tag {
+		response["tag"] = map[string]string{"from": from.Tag, "to": to.Tag}
+	}
+	if from.Mood != to.Mood {
+		response["mood"] = map[string]string{"from": from.Mood, "to": to.Mood}
+	}
+	response["documents"] = diffRevisionDocuments(from.Documents, to.Documents)
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// RestoreNoteRevisionHandler saves the title, content, tag, mood and attachments of a
+// revision as the note's new version; the current version stays in the history
+func RestoreNoteRevisionHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	note, key, err := findAccessibleNote(c, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkNoteVersion(c, note, noteInput{}); err != nil {
+		return err
+	}
+
+	revision, err := findRevision(note.ID, c.Param("revision"), key)
+	if err != nil {
+		return err
+	}
+
+	if err := openNote(&note, key); err != nil {
+		log.Printf("Failed to decrypt note: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to decrypt note"})
+	}
+	note.Title = revision.Title
+	note.Content = revision.Content
+	note.Tag = revision.Tag
+	note.Mood = revision.Mood
+
+	// The attachments go back to the revision's blobs, which it keeps referenced
+	var batch blobBatch
+	defer batch.finish()
+
+	documents := make([]models.Document, 0, len(revision.Documents))
+	for _, document := range revision.Documents {
+		batch.reference(models.Blob{Key: document.BlobKey, Size: document.Size})
+		documents = append(documents, models.Document{
+			UserId:    userID,
+			Name:      document.Name,
+			Type:      document.Type,
+			BlobKey:   document.BlobKey,
+			Size:      document.Size,
+			Encrypted: document.Encrypted,
+		})
+	}
+
+	return storeNote(c, &batch, &note, documents, nil, key, key)
+}
+
+// Helper functions
+
+// findRevision loads a revision of a note with its attachments, decrypted with key
+func findRevision(noteID uint, revisionID string, key []byte) (models.NoteRevision, error) {
+	id, err := strconv.ParseUint(revisionID, 10, 64)
+	if err != nil {
+		return models.NoteRevision{}, jsonError(http.StatusBadRequest, "Invalid revision ID")
+	}
+
+	var revision models.NoteRevision
+	if err := DB.Preload("Documents", byPosition).Where("note_id = ?", noteID).First(&revision, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return revision, jsonError(http.StatusNotFound, "Revision not found")
+		}
+		return revision, jsonError(http.StatusInternalServerError, "Failed to fetch revision")
+	}
+
+	if err := openRevision(&revision, key); err != nil {
+		log.Printf("Failed to decrypt revision %d: %v", revision.ID, err)
+		return revision, jsonError(http.StatusInternalServerError, "Failed to decrypt revision")
+	}
+	return revision, nil
+}
+
+func revisionSummary(revision models.NoteRevision) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        revision.ID,
+		"version":   revision.Version,
+		"createdAt": revision.CreatedAt,
+	}
+}
+
+// diffRevisionDocuments lists the attachments only one of two revisions has; an
+// attachment is the same if both its name and its content are
+func diffRevisionDocuments(from, to []models.RevisionDocument) map[string][]string {
+	type identity struct{ name, blobKey string }
+
+	inFrom := make(map[identity]bool, len(from))
+	for _, document := range from {
+		inFrom[identity{document.Name, document.BlobKey}] = true
+	}
+	inTo := make(map[identity]bool, len(to))
+	for _, document := range to {
+		inTo[identity{document.Name, document.BlobKey}] = true
+	}
+
+	changes := map[string][]string{"removed": {}, "added": {}}
+	for _, document := range from {
+		if !inTo[identity{document.Name, document.BlobKey}] {
+			changes["removed"] = append(changes["removed"], document.Name)
+		}
+	}
+	for _, document := range to {
+		if !inFrom[identity{document.Name, document.BlobKey}] {
+			changes["added"] = append(changes["added"], document.Name)
+		}
+	}
+	return changes
+}
+
+// recordNoteRevision stores a saved note, still sealed with key, as its newest
+// revision and thins out the older ones
+func recordNoteRevision(tx *gorm.DB, batch *blobBatch, note *models.Note, key []byte) error {
+	var documents []models.Document
+	if err := tx.Scopes(byPosition).Omit("data").Where("note_id = ?", note.ID).Find(&documents).Error; err != nil {
+		return err
+	}
+
+	revision := models.NoteRevision{
+		NoteId:         note.ID,
+		UserId:         note.UserId,
+		Version:        note.Version,
+		Title:          note.Title,
+		Content:        note.Content,
+		Tag:            note.Tag,
+		Mood:           note.Mood,
+		TitleEncrypted: note.TitleEncrypted,
+		Encrypted:      key != nil,
+	}
+	for _, document := range documents {
+		if document.BlobKey == "" {
+			continue // Still stored in the database, moved out at startup
+		}
+		batch.reference(models.Blob{Key: document.BlobKey, Size: document.Size})
+		revision.Documents = append(revision.Documents, models.RevisionDocument{
+			Name:      document.Name,
+			Type:      document.Type,
+			BlobKey:   document.BlobKey,
+			Size:      document.Size,
+			Encrypted: document.Encrypted,
+			Position:  document.Position,
+		})
+	}
+
+	if err := tx.Create(&revision).Error; err != nil {
+		return err
+	}
+	return thinNoteRevisions(tx, batch, note.ID, time.Now())
+}
+
+// thinNoteRevisions deletes the revisions that aged out of the retention steps, see
+// RevisionKeepAll and RevisionKeepHourly
+func thinNoteRevisions(tx *gorm.DB, batch *blobBatch, noteID uint, now time.Time) error {
+	var revisions []models.NoteRevision
+	if err := tx.Select("id", "created_at").Where("note_id = ?", noteID).Order("created_at DESC, id DESC").Find(&revisions).Error; err != nil {
+		return err
+	}
+
+	// Revisions come newest first, so the first one seen in a period is its last
+	hours := make(map[int64]bool)
+	days := make(map[int64]bool)
+	var expired []uint
+	for _, revision := range revisions {
+		age := now.Sub(revision.CreatedAt)
+
+		var periods map[int64]bool
+		var period int64
+		switch {
+		case age < RevisionKeepAll:
+			continue
+		case age < RevisionKeepHourly:
+			periods, period = hours, revision.CreatedAt.Unix()/3600
+		default:
+			periods, period = days, revision.CreatedAt.Unix()/86400
+		}
+
+		if periods[period] {
+			expired = append(expired, revision.ID)
+		}
+		periods[period] = true
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+	return deleteNoteRevisions(tx, batch, tx.Where("id IN ?", expired))
+}
+
+// deleteNoteRevisions deletes the revisions matched by query and drops the blobs of
+// their attachments
+func deleteNoteRevisions(tx *gorm.DB, batch *blobBatch, query *gorm.DB) error {
+	var revisionIDs []uint
+	if err := query.Session(&gorm.Session{}).Model(&models.NoteRevision{}).Pluck("id", &revisionIDs).Error; err != nil {
+		return err
+	}
+	if len(revisionIDs) == 0 {
+		return nil
+	}
+
+	var blobKeys []string
+	documents := tx.Model(&models.RevisionDocument{}).Where("revision_id IN ?", revisionIDs)
+	if err := documents.Session(&gorm.Session{}).Pluck("blob_key", &blobKeys).Error; err != nil {
+		return err
+	}
+	if err := documents.Session(&gorm.Session{}).Delete(&models.RevisionDocument{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("id IN ?", revisionIDs).Delete(&models.NoteRevision{}).Error; err != nil {
+		return err
+	}
+
+	batch.drop(blobKeys...)
+	return nil
+}
+
+// rekeyNoteRevisions re-encrypts the revisions of a note and their attachments when
+// the note's key changes, so they open with the same key as the note
+func rekeyNoteRevisions(tx *gorm.DB, batch *blobBatch, noteID uint, oldKey, newKey []byte) error {
+	if noteID == 0 || bytes.Equal(oldKey, newKey) {
+		return nil
+	}
+
+	var revisions []models.NoteRevision
+	if err := tx.Preload("Documents").Where("note_id = ?", noteID).Find(&revisions).Error; err != nil {
+		return fmt.Errorf("failed to fetch revisions: %w", err)
+	}
+
+	for i := range revisions {
+		revision := &revisions[i]
+		if err := openRevision(revision, oldKey); err != nil {
+			return fmt.Errorf("failed to decrypt revision %d: %w", revision.ID, err)
+		}
+		if err := sealRevision(revision, newKey); err != nil {
+			return fmt.Errorf("failed to encrypt revision %d: %w", revision.ID, err)
+		}
+		if err := tx.Model(revision).Select("title", "content", "title_encrypted", "encrypted").UpdateColumns(revision).Error; err != nil {
+			return err
+		}
+
+		for j := range revision.Documents {
+			if err := rekeyRevisionDocument(tx, batch, &revision.Documents[j], oldKey, newKey); err != nil {
+				return fmt.Errorf("failed to re-encrypt document of revision %d: %w", revision.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rekeyRevisionDocument points a revision's attachment at a copy of its blob
+// encrypted with newKey; copies are shared with the note's own attachments
+func rekeyRevisionDocument(tx *gorm.DB, batch *blobBatch, document *models.RevisionDocument, oldKey, newKey []byte) error {
+	if !document.Encrypted && newKey == nil {
+		return nil
+	}
+
+	var key []byte
+	if document.Encrypted {
+		key = oldKey
+	}
+	open := func() (*blobReader, error) { return openBlob(document.BlobKey, key) }
+
+	blobKey, size, err := batch.rewrite(document.BlobKey, open, newKey)
+	if err != nil {
+		return err
+	}
+
+	batch.drop(document.BlobKey)
+	document.BlobKey = blobKey
+	document.Size = size
+	document.Encrypted = newKey != nil
+
+	return tx.Model(document).Select("blob_key", "size", "encrypted").Updates(document).Error
+}
+
+// sealRevision encrypts a revision's content, and its title if the note's was, with
+// the note's key; without a key the revision is stored in plaintext
+func sealRevision(revision *models.NoteRevision, key []byte) error {
+	revision.Encrypted = key != nil
+	if key == nil {
+		revision.TitleEncrypted = false
+		return nil
+	}
+
+	content, err := crypt.SealString(key, revision.Content)
+	if err != nil {
+		return err
+	}
+	revision.Content = content
+
+	if revision.TitleEncrypted {
+		title, err := crypt.SealString(key, revision.Title)
+		if err != nil {
+			return err
+		}
+		revision.Title = title
+	}
+	return nil
+}
+
+// openRevision reverses sealRevision
+func openRevision(revision *models.NoteRevision, key []byte) error {
+	if !revision.Encrypted {
+		return nil
+	}
+
+	content, err := crypt.OpenString(key, revision.Content)
+	if err != nil {
+		return err
+	}
+	revision.Content = content
+
+	if revision.TitleEncrypted {
+		title, err := crypt.OpenString(key, revision.Title)
+		if err != nil {
+			return err
+		}
+		revision.Title = title
+	}
+	return nil
+}
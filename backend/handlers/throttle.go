@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	ThrottleScopeUser = "user"
+	ThrottleScopeNote = "note"
+	// The vault has a single passphrase, its attempts are counted under subject 0
+	ThrottleScopeVault = "vault"
+
+	// Failed attempts allowed before back-off starts
+	ThrottleFreeAttempts = 3
+	ThrottleBaseDelay    = 5 * time.Second
+	ThrottleMaxLockout   = 30 * time.Minute
+
+	AuthOutcomeSuccess = "success"
+	AuthOutcomeFailure = "failure"
+	AuthOutcomeLocked  = "locked"
+)
+
+// throttleLocks holds a mutex for each subject attempts were made on, so that each
+// attempt is checked against the failures of those before it
+var throttleLocks sync.Map
+
+// throttleSubject identifies what a throttle counts attempts on
+type throttleSubject struct {
+	scope string
+	id    uint
+}
+
+// checkThrottle waits for the attempts in progress on the subject, then answers 429
+// while it is locked out and returns a non-nil error in that case; hint is included
+// in the response when set. Otherwise the caller must record the outcome of its
+// attempt before calling release, which lets the next attempt in.
+func checkThrottle(c echo.Context, scope string, subjectID uint, hint string) (release func(), err error) {
+	value, _ := throttleLocks.LoadOrStore(throttleSubject{scope, subjectID}, &sync.Mutex{})
+	lock := value.(*sync.Mutex)
+	lock.Lock()
+
+	if err := checkLockout(c, scope, subjectID, hint); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return lock.Unlock, nil
+}
+
+// recordFailedAttempt counts a failure and locks the subject out for an exponentially
+// growing delay once the free attempts are used up
+func recordFailedAttempt(c echo.Context, scope string, subjectID uint) {
+	recordAuthEvent(c, scope, subjectID, AuthOutcomeFailure)
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		throttle := models.AuthThrottle{Scope: scope, SubjectID: subjectID}
+		if err := tx.Where(&throttle).FirstOrCreate(&throttle).Error; err != nil {
+			return err
+		}
+
+		throttle.Failures++
+		if delay := throttleDelay(throttle.Failures); delay > 0 {
+			lockedUntil := time.Now().Add(delay)
+			throttle.LockedUntil = &lockedUntil
+		}
+
+		return tx.Save(&throttle).Error
+	})
+	if err != nil {
+		log.Printf("Failed to record %s attempt: %v", scope, err)
+	}
+}
+
+// recordSuccessfulAttempt clears the subject's failure count
+func recordSuccessfulAttempt(c echo.Context, scope string, subjectID uint) {
+	recordAuthEvent(c, scope, subjectID, AuthOutcomeSuccess)
+
+	err := DB.Where("scope = ? AND subject_id = ?", scope, subjectID).Delete(&models.AuthThrottle{}).Error
+	if err != nil {
+		log.Printf("Failed to reset %s attempts: %v", scope, err)
+	}
+}
+
+func throttleDelay(failures int) time.Duration {
+	if failures < ThrottleFreeAttempts {
+		return 0
+	}
+
+	delay := ThrottleBaseDelay << (failures - ThrottleFreeAttempts)
+	if delay <= 0 || delay > ThrottleMaxLockout {
+		return ThrottleMaxLockout
+	}
+	return delay
+}
+
+func recordAuthEvent(c echo.Context, scope string, subjectID uint, outcome string) {
+	event := models.AuthEvent{
+		Scope:     scope,
+		SubjectID: subjectID,
+		Outcome:   outcome,
+		RemoteIP:  c.RealIP(),
+	}
+	if err := DB.Create(&event).Error; err != nil {
+		log.Printf("Failed to record %s event: %v", scope, err)
+	}
+}
+
+// checkLockout answers 429 while the subject is locked out
+func checkLockout(c echo.Context, scope string, subjectID uint, hint string) error {
+	var throttle models.AuthThrottle
+	err := DB.Where("scope = ? AND subject_id = ?", scope, subjectID).First(&throttle).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to read %s throttle: %v", scope, err)
+		return jsonError(http.StatusInternalServerError, "Failed to check login attempts")
+	}
+
+	if throttle.LockedUntil == nil || time.Now().After(*throttle.LockedUntil) {
+		return nil
+	}
+
+	recordAuthEvent(c, scope, subjectID, AuthOutcomeLocked)
+
+	retryAfter := int(math.Ceil(time.Until(*throttle.LockedUntil).Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	response := map[string]interface{}{
+		"error":       "Too many failed attempts, try again later",
+		"retryAfter":  retryAfter,
+		"lockedUntil": throttle.LockedUntil,
+	}
+	if hint != "" {
+		response["hint"] = hint
+	}
+	return echo.NewHTTPError(http.StatusTooManyRequests, response)
+}
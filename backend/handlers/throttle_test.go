@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoginLockout(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "secret")
+
+	e := echo.New()
+	e.POST("/login", LoginHandler)
+	login := func(password string) int {
+		rec := postForm(e, "/login", url.Values{"id": {strconv.Itoa(int(user.ID))}, "password": {password}})
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Error("lockout without Retry-After")
+		}
+		return rec.Code
+	}
+
+	for i := 0; i < ThrottleFreeAttempts; i++ {
+		if code := login("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("failed attempt %d got status %d, want 401", i+1, code)
+		}
+	}
+
+	// Locked out, even with the right password
+	if code := login("secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d during the lockout, want 429", code)
+	}
+
+	// Once the lockout is over, a successful login clears the failures
+	err := DB.Model(&models.AuthThrottle{}).Where("scope = ? AND subject_id = ?", ThrottleScopeUser, user.ID).
+		Update("locked_until", time.Now().Add(-time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := login("secret"); code != http.StatusOK {
+		t.Fatalf("got status %d after the lockout, want 200", code)
+	}
+
+	var throttles int64
+	if err := DB.Model(&models.AuthThrottle{}).Count(&throttles).Error; err != nil {
+		t.Fatal(err)
+	}
+	if throttles != 0 {
+		t.Error("failures kept after a successful login")
+	}
+}
+
+func TestConcurrentGuessesAreThrottled(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "secret")
+
+	e := echo.New()
+	e.POST("/login", LoginHandler)
+
+	const guesses = 3 * ThrottleFreeAttempts
+	statuses := make(chan int, guesses)
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := postForm(e, "/login", url.Values{"id": {strconv.Itoa(int(user.ID))}, "password": {fmt.Sprintf("guess %d", i)}})
+			statuses <- rec.Code
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	// Only the free attempts get their password checked, the others find the lockout
+	if counts[http.StatusUnauthorized] != ThrottleFreeAttempts || counts[http.StatusTooManyRequests] != guesses-ThrottleFreeAttempts {
+		t.Errorf("got statuses %v, want %d times 401 and the rest 429", counts, ThrottleFreeAttempts)
+	}
+}
+
+func TestThrottleDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{ThrottleFreeAttempts - 1, 0},
+		{ThrottleFreeAttempts, ThrottleBaseDelay},
+		{ThrottleFreeAttempts + 1, 2 * ThrottleBaseDelay},
+		{ThrottleFreeAttempts + 3, 8 * ThrottleBaseDelay},
+		{ThrottleFreeAttempts + 20, ThrottleMaxLockout},
+		{ThrottleFreeAttempts + 100, ThrottleMaxLockout},
+	}
+
+	for _, test := range tests {
+		if got := throttleDelay(test.failures); got != test.want {
+			t.Errorf("throttleDelay(%d) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+}
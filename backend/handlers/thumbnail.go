@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"yana-back/models"
+	"yana-back/thumbnail"
+	"yana-back/vault"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Thumbnails caches rendered thumbnails by the key of their source blob
+var Thumbnails *thumbnail.Cache
+
+// thumbnailSlots bounds the number of images decoded at once, as a large image
+// takes a lot of memory while it is scaled
+var thumbnailSlots = make(chan struct{}, 2)
+
+// thumbnailSource describes the image a thumbnail is rendered from
+type thumbnailSource struct {
+	// blobKey is empty for content still stored in the database
+	blobKey string
+	// cacheable is false for attachments of locked notes, whose thumbnails would
+	// leak their content
+	cacheable bool
+	modTime   time.Time
+	etag      string
+	open      func() (*blobReader, error)
+}
+
+// GetDocumentThumbnailHandler sends a scaled down rendition of an image attachment or
+// background picture, ?size= picks one of thumbnail.Sizes
+func GetDocumentThumbnailHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	size, err := parseThumbnailSize(c)
+	if err != nil {
+		return err
+	}
+
+	documentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid document ID"})
+	}
+
+	var document models.Document
+	if err := DB.Scopes(ownedBy(userID)).First(&document, documentID).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Document not found"})
+	}
+
+	key, err := requireDocumentAccess(document, userID)
+	if err != nil {
+		return err
+	}
+
+	if document.Type != nil && !strings.HasPrefix(*document.Type, "image/") {
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "Document is not an image"})
+	}
+
+	return serveThumbnail(c, thumbnailSource{
+		blobKey:   document.BlobKey,
+		cacheable: !document.Encrypted,
+		modTime:   document.UpdatedAt,
+		etag:      fmt.Sprintf(`"%s-%d"`, documentVersion(document), size),
+		open:      func() (*blobReader, error) { return openDocument(document, key) },
+	}, size)
+}
+
+// GetProfilePictureThumbnailHandler sends a scaled down rendition of a user's profile
+// picture, ?size= picks one of thumbnail.Sizes
+func GetProfilePictureThumbnailHandler(c echo.Context) error {
+	userID, err := parseSessionUserParam(c)
+	if err != nil {
+		return err
+	}
+
+	size, err := parseThumbnailSize(c)
+	if err != nil {
+		return err
+	}
+
+	var user models.User
+	if err := DB.Select("id", "profile_picture_key", "profile_picture", "updated_at").First(&user, "id = ?", userID).Error; err != nil {
+		return handleDBError(c, err, "User not found", "Failed to retrieve profile document")
+	}
+	if user.ProfilePictureKey == "" && len(user.ProfilePicture) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No profile document found for the user"})
+	}
+
+	content := "u" + strconv.FormatUint(uint64(user.ID), 10)
+	if user.ProfilePictureKey != "" {
+		content = user.ProfilePictureKey[:16]
+	}
+
+	return serveThumbnail(c, thumbnailSource{
+		blobKey:   user.ProfilePictureKey,
+		cacheable: true,
+		modTime:   user.UpdatedAt,
+		etag:      fmt.Sprintf(`"%s-%x-%d"`, content, user.UpdatedAt.UnixNano(), size),
+		open:      func() (*blobReader, error) { return openProfilePicture(user) },
+	}, size)
+}
+
+// Helper functions
+
+func parseThumbnailSize(c echo.Context) (int, error) {
+	value := c.QueryParam("size")
+	if value == "" {
+		return thumbnail.DefaultSize, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || !thumbnail.ValidSize(size) {
+		return 0, jsonError(http.StatusBadRequest, fmt.Sprintf("Invalid thumbnail size, use one of %v", thumbnail.Sizes))
+	}
+	return size, nil
+}
+
+// serveThumbnail sends the cached thumbnail of source, rendering and caching it first
+// if needed
+func serveThumbnail(c echo.Context, source thumbnailSource, size int) error {
+	cacheable := source.cacheable && source.blobKey != "" && Thumbnails != nil
+
+	var data []byte
+	if cacheable {
+		cached, err := readCachedThumbnail(source.blobKey, size)
+		if err != nil {
+			log.Printf("Failed to read cached thumbnail: %v", err)
+		}
+		data = cached
+	}
+
+	if data == nil {
+		rendered, err := renderThumbnail(source, size)
+		switch {
+		case errors.Is(err, thumbnail.ErrUnsupported):
+			return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "Document is not a supported image"})
+		case errors.Is(err, thumbnail.ErrTooLarge):
+			return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "Image is too large for a thumbnail"})
+		case err != nil:
+			log.Printf("Failed to render thumbnail: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to render thumbnail"})
+		}
+		data = rendered
+
+		if cacheable {
+			if err := storeThumbnail(source.blobKey, size, data); err != nil {
+				log.Printf("Failed to cache thumbnail: %v", err)
+			}
+		}
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, http.DetectContentType(data))
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	header.Set("ETag", source.etag)
+	header.Set(echo.HeaderCacheControl, "private, no-cache")
+
+	http.ServeContent(c.Response(), c.Request(), "", source.modTime, bytes.NewReader(data))
+	return nil
+}
+
+func renderThumbnail(source thumbnailSource, size int) ([]byte, error) {
+	reader, err := source.open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+
+	var buf bytes.Buffer
+	if err := thumbnail.Render(&buf, reader, size); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readCachedThumbnail returns nil when the thumbnail is not cached yet
+func readCachedThumbnail(blobKey string, size int) ([]byte, error) {
+	file, err := Thumbnails.Open(blobKey, size)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sealed, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cached thumbnails are encrypted like their source in vault mode
+	reader, err := vault.NewReader(io.NewSectionReader(bytes.NewReader(sealed), 0, int64(len(sealed))))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.NewSectionReader(reader, 0, reader.Size()))
+}
+
+func storeThumbnail(blobKey string, size int, data []byte) error {
+	return Thumbnails.Store(blobKey, size, func(w io.Writer) error {
+		vaultWriter, err := vault.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		if _, err := vaultWriter.Write(data); err != nil {
+			return err
+		}
+		return vaultWriter.Close()
+	})
+}
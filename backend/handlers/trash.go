@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	TrashPurgeInterval = time.Hour
+)
+
+// TrashRetention is how long deleted notes stay in the trash, 0 keeps them until the
+// trash is emptied
+var TrashRetention time.Duration
+
+// GetTrashHandler lists the user's deleted notes, most recently deleted first
+func GetTrashHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var notes []models.Note
+	if err := trashedNotes(DB, userID).Order("deleted_at DESC").Find(&notes).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch trash"})
+	}
+
+	responses := buildNotesResponse(notes)
+	for i, note := range notes {
+		responses[i]["deletedAt"] = note.DeletedAt.Time
+		if TrashRetention > 0 {
+			responses[i]["purgeAt"] = note.DeletedAt.Time.Add(TrashRetention)
+		}
+	}
+	if responses == nil {
+		responses = []map[string]interface{}{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"notes": responses})
+}
+
+// RestoreNoteHandler takes a note out of the trash, attachments included
+func RestoreNoteHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	noteID, err := parseNoteID(c)
+	if err != nil {
+		return err
+	}
+
+	result := trashedNotes(DB, userID).Where("id = ?", noteID).UpdateColumn("deleted_at", nil)
+	if result.Error != nil {
+		log.Printf("Failed to restore note: %v", result.Error)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to restore note"})
+	}
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Note not found in trash"})
+	}
+
+	var note models.Note
+	if err := DB.Scopes(ownedBy(userID)).Preload("Documents", byPosition).First(&note, noteID).Error; err != nil {
+		return handleDBError(c, err, "Note not found", "Failed to fetch note")
+	}
+
+	setNoteETag(c, note)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("Note with ID %d restored", noteID),
+		"note":    buildNoteResponse(note, false),
+	})
+}
+
+// PurgeNoteHandler permanently deletes a note in the trash with all its documents
+func PurgeNoteHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	noteID, err := parseNoteID(c)
+	if err != nil {
+		return err
+	}
+
+	purged, err := purgeNotes(context.Background(), trashedNotes(DB, userID).Where("id = ?", noteID))
+	if err != nil {
+		log.Printf("Failed to delete note: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete note"})
+	}
+	if purged == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Note not found in trash"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Note with ID %d and all its documents deleted permanently", noteID),
+	})
+}
+
+// EmptyTrashHandler permanently deletes every note in the user's trash
+func EmptyTrashHandler(c echo.Context) error {
+	userID, err := parseUserID(c)
+	if err != nil {
+		return err
+	}
+
+	purged, err := purgeNotes(context.Background(), trashedNotes(DB, userID))
+	if err != nil {
+		log.Printf("Failed to empty trash: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to empty trash"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("%d notes deleted permanently", purged),
+		"deleted": purged,
+	})
+}
+
+// PurgeTrash permanently deletes the notes that stayed in the trash longer than
+// TrashRetention
+func PurgeTrash(ctx context.Context) error {
+	if TrashRetention <= 0 {
+		return nil
+	}
+
+	query := DB.Unscoped().Model(&models.Note{}).Where("deleted_at < ?", time.Now().Add(-TrashRetention))
+	purged, err := purgeNotes(ctx, query)
+	if purged > 0 {
+		log.Printf("Purged %d notes from the trash", purged)
+	}
+	return err
+}
+
+// Helper functions
+
+// trashedNotes scopes a query to the notes in a user's trash
+func trashedNotes(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Unscoped().Model(&models.Note{}).Scopes(ownedBy(userID)).Where("deleted_at IS NOT NULL")
+}
+
+// purgeNotes permanently deletes the notes matched by query, each in its own
+// transaction, and returns how many were deleted
+func purgeNotes(ctx context.Context, query *gorm.DB) (int, error) {
+	var notes []models.Note
+	if err := query.Select("id", "user_id", "b_picture_id").Find(&notes).Error; err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, note := range notes {
+		if ctx.Err() != nil {
+			return purged, ctx.Err()
+		}
+
+		var batch blobBatch
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := purgeNote(tx, &batch, note); err != nil {
+				return err
+			}
+			return batch.commit(tx)
+		})
+		batch.finish()
+		if err != nil {
+			return purged, fmt.Errorf("failed to delete note %d: %w", note.ID, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeNote deletes a note with its attachments, background picture and revisions
+func purgeNote(tx *gorm.DB, batch *blobBatch, note models.Note) error {
+	if err := deleteDocuments(batch, tx.Where("note_id = ?", note.ID)); err != nil {
+		return err
+	}
+	if note.BPictureId != nil {
+		if err := deleteDocuments(batch, tx.Scopes(ownedBy(note.UserId)).Where("id = ? AND note_id = 0", *note.BPictureId)); err != nil {
+			return err
+		}
+	}
+	if err := deleteNoteRevisions(tx, batch, tx.Where("note_id = ?", note.ID)); err != nil {
+		return err
+	}
+	return tx.Unscoped().Delete(&models.Note{}, note.ID).Error
+}
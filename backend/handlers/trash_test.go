@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"yana-back/models"
+
+	"gorm.io/gorm"
+)
+
+func TestPurgeTrash(t *testing.T) {
+	setupBlobStore(t)
+	oldRetention := TrashRetention
+	TrashRetention = 24 * time.Hour
+	t.Cleanup(func() { TrashRetention = oldRetention })
+
+	_, expiredBlob := createTrashedNote(t, time.Now().Add(-2*TrashRetention))
+	recent, recentBlob := createTrashedNote(t, time.Now().Add(-time.Hour))
+	kept, keptBlob := createTrashedNote(t, time.Time{})
+
+	if err := PurgeTrash(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []uint
+	if err := DB.Unscoped().Model(&models.Note{}).Order("id").Pluck("id", &remaining).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 || remaining[0] != recent.ID || remaining[1] != kept.ID {
+		t.Errorf("notes %v remain, want %d and %d", remaining, recent.ID, kept.ID)
+	}
+
+	checkBlob(t, expiredBlob, -1)
+	checkBlob(t, recentBlob, 1)
+	checkBlob(t, keptBlob, 1)
+}
+
+// createTrashedNote stores a note with an attachment, moved to the trash at deletedAt
+// unless it is zero, and returns it with the attachment's blob
+func createTrashedNote(t *testing.T, deletedAt time.Time) (models.Note, string) {
+	t.Helper()
+	note := models.Note{UserId: 1, Title: "note"}
+	if err := DB.Create(&note).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !deletedAt.IsZero() {
+		if err := DB.Model(&note).Update("deleted_at", deletedAt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var batch blobBatch
+	defer batch.finish()
+	blobKey, size, err := batch.write(strings.NewReader(fmt.Sprintf("attachment of note %d", note.ID)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		document := models.Document{UserId: note.UserId, NoteId: note.ID, Name: "file.txt", BlobKey: blobKey, Size: size}
+		if err := tx.Create(&document).Error; err != nil {
+			return err
+		}
+		return batch.commit(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return note, blobKey
+}
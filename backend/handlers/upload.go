@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// UploadLimits restrict what users may upload, zero values disable a limit
+type UploadLimits struct {
+	MaxFileSize int64
+	// UserQuota bounds the total size of a user's attachments and profile picture
+	UserQuota int64
+	// AllowedTypes are content types like "application/pdf" or patterns like
+	// "image/*"; an empty list or "*/*" allows any type
+	AllowedTypes []string
+}
+
+// Uploads holds the limits main sets from the configuration
+var Uploads UploadLimits
+
+// upload is an uploaded file that passed the upload limits
+type upload struct {
+	io.Reader
+	io.Closer
+	contentType string
+}
+
+// zipFormats are the types stored in zip files, which sniffing reports as zip
+var zipFormats = []string{
+	"application/epub+zip",
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+}
+
+// oleFormats are the legacy Office types stored in OLE compound files
+var oleFormats = []string{
+	"application/msword",
+	"application/vnd.ms-",
+}
+
+// ftypBrands maps the major brand of ISO media files to the types net/http does not
+// detect
+var ftypBrands = map[string]string{
+	"qt  ": "video/quicktime",
+	"M4A ": "audio/mp4",
+	"M4V ": "video/mp4",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"avis": "image/avif",
+}
+
+var oleSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// LimitRequestSize rejects request bodies larger than limit bytes with 413, 0
+// disables the limit
+func LimitRequestSize(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if limit <= 0 {
+				return next(c)
+			}
+
+			req := c.Request()
+			if req.ContentLength > limit {
+				return tooLargeError(fmt.Sprintf("Request is larger than the %s limit", formatSize(limit)), limit)
+			}
+
+			// Bodies of unknown length are cut off, see requestSizeError
+			req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+			return next(c)
+		}
+	}
+}
+
+// Helper functions
+
+// openUpload checks an uploaded file against the size limit and the allowed types,
+// detected from its content, and opens it. imagesOnly restricts it to images.
+func openUpload(fileHeader *multipart.FileHeader, imagesOnly bool) (*upload, error) {
+	if limit := Uploads.MaxFileSize; limit > 0 && fileHeader.Size > limit {
+		return nil, tooLargeError(fmt.Sprintf("'%s' is larger than the %s limit", fileHeader.Filename, formatSize(limit)), limit)
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	// The start of the file is enough to sniff its type
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		file.Close()
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	head = head[:n]
+
+	contentType := determineContentType(fileHeader, head)
+	if imagesOnly && !strings.HasPrefix(contentType, "image/") {
+		file.Close()
+		return nil, jsonError(http.StatusUnsupportedMediaType, fmt.Sprintf("'%s' is not an image", fileHeader.Filename))
+	}
+	if !allowedContentType(contentType) {
+		file.Close()
+		return nil, jsonError(http.StatusUnsupportedMediaType, fmt.Sprintf("'%s' has the unsupported type %s", fileHeader.Filename, mediaType(contentType)))
+	}
+
+	return &upload{
+		Reader:      io.MultiReader(bytes.NewReader(head), file),
+		Closer:      file,
+		contentType: contentType,
+	}, nil
+}
+
+// determineContentType detects a file's type from its content. The type the client
+// declared only refines what sniffing cannot tell apart: the formats stored in zip
+// and OLE files, and the kinds of text.
+func determineContentType(fileHeader *multipart.FileHeader, head []byte) string {
+	sniffed := sniffContentType(head)
+
+	declared := mediaType(fileHeader.Header.Get(echo.HeaderContentType))
+	if declared == "" || declared == echo.MIMEOctetStream {
+		declared = mediaType(mime.TypeByExtension(filepath.Ext(fileHeader.Filename)))
+	}
+	if declared == "" {
+		return sniffed
+	}
+
+	switch mediaType(sniffed) {
+	case "application/zip":
+		if hasAnyPrefix(declared, zipFormats) {
+			return declared
+		}
+	case "application/x-ole-storage":
+		if hasAnyPrefix(declared, oleFormats) {
+			return declared
+		}
+	case "text/plain", "text/xml":
+		if strings.HasPrefix(declared, "text/") || declared == echo.MIMEApplicationJSON || declared == "application/xml" || declared == "image/svg+xml" {
+			// Keep the detected charset
+			_, params, _ := mime.ParseMediaType(sniffed)
+			return mime.FormatMediaType(declared, params)
+		}
+	}
+	return sniffed
+}
+
+// sniffContentType adds a few common formats to http.DetectContentType
+func sniffContentType(head []byte) string {
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		if contentType, ok := ftypBrands[string(head[8:12])]; ok {
+			return contentType
+		}
+	}
+	if bytes.HasPrefix(head, oleSignature) {
+		return "application/x-ole-storage"
+	}
+	// MP3 files without an ID3 tag start with a frame header
+	if len(head) >= 2 && head[0] == 0xFF && head[1]&0xE6 == 0xE2 {
+		return "audio/mpeg"
+	}
+	return http.DetectContentType(head)
+}
+
+func allowedContentType(contentType string) bool {
+	if len(Uploads.AllowedTypes) == 0 {
+		return true
+	}
+
+	contentType = mediaType(contentType)
+	for _, pattern := range Uploads.AllowedTypes {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*/*" || pattern == contentType:
+			return true
+		case strings.HasSuffix(pattern, "*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// checkStorageQuota rejects the files uploaded in fields when they would take the
+// user over the storage quota; replaced is the size of the stored files they replace
+func checkStorageQuota(c echo.Context, userID uint, replaced int64, fields ...string) error {
+	quota := Uploads.UserQuota
+	if quota <= 0 {
+		return nil
+	}
+
+	incoming := uploadedSize(c, fields...)
+	if incoming == 0 {
+		return nil
+	}
+
+	used, err := storageUsed(DB, userID)
+	if err != nil {
+		log.Printf("Failed to compute storage use: %v", err)
+		return jsonError(http.StatusInternalServerError, "Failed to check storage quota")
+	}
+
+	if used-replaced+incoming > quota {
+		free := max(0, quota-used+replaced)
+		return tooLargeError(fmt.Sprintf("Storage quota of %s exceeded, %s left", formatSize(quota), formatSize(free)), quota)
+	}
+	return nil
+}
+
+// recheckStorageQuota repeats the quota check in the transaction that stores uploads,
+// after their rows are written. Concurrent uploads each pass checkStorageQuota alone;
+// the transaction sees those committed before it.
+func recheckStorageQuota(tx *gorm.DB, userID uint) error {
+	quota := Uploads.UserQuota
+	if quota <= 0 {
+		return nil
+	}
+
+	used, err := storageUsed(tx, userID)
+	if err != nil {
+		log.Printf("Failed to compute storage use: %v", err)
+		return jsonError(http.StatusInternalServerError, "Failed to check storage quota")
+	}
+
+	if used > quota {
+		return tooLargeError(fmt.Sprintf("Storage quota of %s exceeded", formatSize(quota)), quota)
+	}
+	return nil
+}
+
+// uploadedSize sums the sizes of the files uploaded in fields
+func uploadedSize(c echo.Context, fields ...string) int64 {
+	if !isMultipartRequest(c) {
+		return 0
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return 0 // Reported when the files are read
+	}
+
+	var size int64
+	for _, field := range fields {
+		for _, fileHeader := range form.File[field] {
+			size += fileHeader.Size
+		}
+	}
+	return size
+}
+
+// storageUsed sums the sizes of a user's attachments, background pictures and
+// profile picture
+func storageUsed(db *gorm.DB, userID uint) (int64, error) {
+	documents, err := documentsSize(db.Scopes(ownedBy(userID)))
+	if err != nil {
+		return 0, err
+	}
+
+	var profilePicture int64
+	err = db.Model(&models.Blob{}).
+		Joins("JOIN users ON users.profile_picture_key = blobs.key").
+		Where("users.id = ?", userID).
+		Select("COALESCE(SUM(blobs.size), 0)").
+		Scan(&profilePicture).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return documents + profilePicture, nil
+}
+
+// documentsSize sums the sizes of the documents query matches
+func documentsSize(query *gorm.DB) (int64, error) {
+	var size int64
+	err := query.Model(&models.Document{}).Select("COALESCE(SUM(size), 0)").Scan(&size).Error
+	return size, err
+}
+
+// blobSize returns the content size of a stored blob, 0 for an empty key
+func blobSize(key string) (int64, error) {
+	if key == "" {
+		return 0, nil
+	}
+
+	var size int64
+	err := DB.Model(&models.Blob{}).Where("key = ?", key).Select("COALESCE(SUM(size), 0)").Scan(&size).Error
+	return size, err
+}
+
+// requestSizeError turns the error of reading a body cut off by LimitRequestSize into
+// a 413 response, nil for other errors
+func requestSizeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return nil
+	}
+	return tooLargeError(fmt.Sprintf("Request is larger than the %s limit", formatSize(maxBytesErr.Limit)), maxBytesErr.Limit)
+}
+
+// tooLargeError builds a 413 response that also tells the exceeded limit in bytes
+func tooLargeError(message string, limit int64) error {
+	return echo.NewHTTPError(http.StatusRequestEntityTooLarge, map[string]interface{}{
+		"error": message,
+		"limit": limit,
+	})
+}
+
+// isHTTPError reports whether err already describes the response to send
+func isHTTPError(err error) bool {
+	var httpErr *echo.HTTPError
+	return errors.As(err, &httpErr)
+}
+
+func isMultipartRequest(c echo.Context) bool {
+	return strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm)
+}
+
+// mediaType strips the parameters from a content type, "" if it is invalid
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatSize renders a byte count with a binary unit, like "1.5 MiB"
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
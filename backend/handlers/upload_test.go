@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+func TestRecheckStorageQuota(t *testing.T) {
+	setupTestDB(t)
+	oldUploads := Uploads
+	Uploads = UploadLimits{UserQuota: 100}
+	t.Cleanup(func() { Uploads = oldUploads })
+
+	// Two uploads that each fit the quota alone, stored one after the other
+	store := func(userID uint, size int64) error {
+		return DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&models.Document{UserId: userID, NoteId: 1, Name: "file.txt", Size: size}).Error; err != nil {
+				return err
+			}
+			return recheckStorageQuota(tx, userID)
+		})
+	}
+
+	if err := store(1, 60); err != nil {
+		t.Fatal(err)
+	}
+	var httpErr *echo.HTTPError
+	if err := store(1, 50); !errors.As(err, &httpErr) || httpErr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %v, want 413", err)
+	}
+	// Other users' storage does not count
+	if err := store(2, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	used, err := storageUsed(DB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 60 {
+		t.Errorf("user stores %d bytes, want the 60 of the first upload", used)
+	}
+}
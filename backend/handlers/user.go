@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
@@ -43,22 +42,29 @@ type MediaPlayer struct {
 	Args []string
 }
 
-// SaveUserHandler handles creation or update of a User, including profile picture
+// SaveUserHandler handles update of the logged-in User, including profile picture, from a
+// form or JSON body
 func SaveUserHandler(c echo.Context) error {
-	user, err := findOrCreateUser(c)
+	input, err := bindUserInput(c)
 	if err != nil {
 		return err
 	}
 
-	if err := updateUserFields(&user, c); err != nil {
+	user, err := findRequestedUser(c, input.ID)
+	if err != nil {
 		return err
 	}
 
-	if err := handleProfilePicture(&user, c); err != nil {
+	updateUserFields(&user, input)
+
+	var batch blobBatch
+	defer batch.finish()
+
+	if err := handleProfilePicture(&user, &batch, c); err != nil {
 		return err
 	}
 
-	if err := saveUser(&user); err != nil {
+	if err := saveUser(&user, &batch); err != nil {
 		return err
 	}
 
@@ -70,7 +76,10 @@ func SaveUserHandler(c echo.Context) error {
 
 // GetUserByIDHandler retrieves a user by their ID
 func GetUserByIDHandler(c echo.Context) error {
-	userID := c.Param("id")
+	userID, err := parseSessionUserParam(c)
+	if err != nil {
+		return err
+	}
 
 	var user models.User
 	if err := DB.First(&user, "id = ?", userID).Error; err != nil {
@@ -82,20 +91,30 @@ func GetUserByIDHandler(c echo.Context) error {
 
 // GetUserProfilePictureHandler retrieves and serves a user's profile picture
 func GetUserProfilePictureHandler(c echo.Context) error {
-	userID := c.Param("id")
+	userID, err := parseSessionUserParam(c)
+	if err != nil {
+		return err
+	}
 
 	var user models.User
-	if err := DB.Select("profile_picture").First(&user, "id = ?", userID).Error; err != nil {
+	if err := DB.Select("profile_picture_key", "profile_picture").First(&user, "id = ?", userID).Error; err != nil {
 		return handleDBError(c, err, "User not found", "Failed to retrieve profile document")
 	}
 
-	if len(user.ProfilePicture) == 0 {
+	reader, err := openProfilePicture(user)
+	if err != nil {
+		log.Printf("Failed to open profile picture: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve profile document"})
+	}
+	if reader == nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
 			"error": "No profile document found for the user",
 		})
 	}
+	defer reader.Close()
 
-	return c.Blob(http.StatusOK, "", user.ProfilePicture)
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(reader.Size(), 10))
+	return c.Stream(http.StatusOK, "", reader)
 }
 
 // PlayPomodoroHandler plays the pomodoro notification sound
@@ -118,84 +137,129 @@ func PlayPomodoroHandler(c echo.Context) error {
 
 // Helper functions
 
-func findOrCreateUser(c echo.Context) (models.User, error) {
-	userIDStr := c.FormValue("id")
-	if userIDStr == "" {
-		return models.User{}, nil
+// userInput holds the profile fields of a user as sent in a form or JSON body
+type userInput struct {
+	ID       *int    `json:"id"`
+	Name     *string `json:"name"`
+	NickName *string `json:"nick_name"`
+	Language *string `json:"language"`
+	Hint     *string `json:"hint"`
+	Password *string `json:"password"`
+}
+
+func bindUserInput(c echo.Context) (userInput, error) {
+	var input userInput
+	if isJSONRequest(c) {
+		err := bindJSON(c, &input)
+		return input, err
 	}
 
-	userID, err := strconv.Atoi(userIDStr)
+	id, err := formInt(c, "id")
 	if err != nil {
-		return models.User{}, c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid user ID",
-		})
+		return input, jsonError(http.StatusNotFound, "User not found")
+	}
+
+	input.ID = id
+	input.Name = formString(c, "name")
+	input.NickName = formString(c, "nick_name")
+	input.Language = formString(c, "language")
+	input.Hint = formString(c, "hint")
+	input.Password = formString(c, "password")
+	return input, nil
+}
+
+func findSessionUser(c echo.Context) (models.User, error) {
+	requestedID, err := formInt(c, "id")
+	if err != nil {
+		return models.User{}, jsonError(http.StatusNotFound, "User not found")
+	}
+	return findRequestedUser(c, requestedID)
+}
+
+// findRequestedUser loads the logged-in user; the requested ID is optional, but must
+// not name another user
+func findRequestedUser(c echo.Context, requestedID *int) (models.User, error) {
+	userID := sessionUserID(c)
+	if requestedID != nil && uint(*requestedID) != userID {
+		return models.User{}, jsonError(http.StatusNotFound, "User not found")
 	}
 
 	var user models.User
 	if err := DB.First(&user, userID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return models.User{}, c.JSON(http.StatusNotFound, map[string]string{
-				"error": "User not found",
-			})
+			return models.User{}, jsonError(http.StatusNotFound, "User not found")
 		}
-		return models.User{}, c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to fetch user",
-		})
+		return models.User{}, jsonError(http.StatusInternalServerError, "Failed to fetch user")
 	}
 
 	return user, nil
 }
 
-func updateUserFields(user *models.User, c echo.Context) error {
-	user.Name = c.FormValue("name")
-	user.NickName = c.FormValue("nick_name")
-	user.Language = c.FormValue("language")
-	user.Hint = c.FormValue("hint")
-
-	password := c.FormValue("password")
-	if password != "" {
-		hashedPassword, err := hashPassword(password)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to hash password",
-			})
-		}
-		user.Password = hashedPassword
+// parseSessionUserParam reads the :id path parameter, which must be the logged-in user
+func parseSessionUserParam(c echo.Context) (uint, error) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return 0, jsonError(http.StatusBadRequest, "Invalid user ID")
 	}
 
-	return nil
+	if uint(userID) != sessionUserID(c) {
+		return 0, jsonError(http.StatusNotFound, "User not found")
+	}
+
+	return uint(userID), nil
+}
+
+// updateUserFields copies the profile fields; passwords only change through the
+// dedicated password endpoints
+func updateUserFields(user *models.User, input userInput) {
+	user.Name = stringValue(input.Name)
+	user.NickName = stringValue(input.NickName)
+	user.Language = stringValue(input.Language)
+	user.Hint = stringValue(input.Hint)
 }
 
-func handleProfilePicture(user *models.User, c echo.Context) error {
+// handleProfilePicture streams an uploaded profile picture into the blob store
+func handleProfilePicture(user *models.User, batch *blobBatch, c echo.Context) error {
 	profilePicFile, err := c.FormFile("profile_picture")
 	if err != nil || profilePicFile == nil {
-		return nil // No profile picture provided
+		return requestSizeError(err) // Otherwise no profile picture provided
 	}
 
-	profilePicData, err := readFileData(profilePicFile)
+	replaced, err := blobSize(user.ProfilePictureKey)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to process profile picture",
-		})
+		log.Printf("Failed to compute replaced storage: %v", err)
+		return jsonError(http.StatusInternalServerError, "Failed to check storage quota")
+	}
+	if err := checkStorageQuota(c, user.ID, replaced, "profile_picture"); err != nil {
+		return err
 	}
 
-	user.ProfilePicture = profilePicData
+	blobKey, err := writeFileBlob(profilePicFile, batch)
+	if isHTTPError(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to store profile picture: %v", err)
+		return jsonError(http.StatusInternalServerError, "Failed to process profile picture")
+	}
+
+	batch.drop(user.ProfilePictureKey)
+	user.ProfilePictureKey = blobKey
+	user.ProfilePicture = nil
 	return nil
 }
 
-func readFileData(fileHeader *multipart.FileHeader) ([]byte, error) {
-	file, err := fileHeader.Open()
+// writeFileBlob stores an uploaded image, rejecting files over the upload limits with
+// an HTTP error
+func writeFileBlob(fileHeader *multipart.FileHeader, batch *blobBatch) (string, error) {
+	file, err := openUpload(fileHeader, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return "", err
 	}
 	defer file.Close()
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file data: %w", err)
-	}
-
-	return data, nil
+	blobKey, _, err := batch.write(file, nil)
+	return blobKey, err
 }
 
 func hashPassword(password string) (string, error) {
@@ -206,8 +270,22 @@ func hashPassword(password string) (string, error) {
 	return string(hashedPassword), nil
 }
 
-func saveUser(user *models.User) error {
-	if err := DB.Save(user).Error; err != nil {
+func checkPassword(hashedPassword, password string) bool {
+	// Users without a password log in with an empty one
+	if hashedPassword == "" {
+		return password == ""
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+}
+
+func saveUser(user *models.User, batch *blobBatch) error {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		return batch.commit(tx)
+	})
+	if err != nil {
 		log.Printf("Failed to save user: %v", err)
 		return fmt.Errorf("failed to save user: %w", err)
 	}
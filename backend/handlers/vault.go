@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"yana-back/vault"
+
+	"github.com/labstack/echo/v4"
+)
+
+// lockedVaultRoutes are the only routes served until the vault is unlocked
+var lockedVaultRoutes = map[string]bool{
+	"/health":       true,
+	"/vault/unlock": true,
+}
+
+// VaultUnlocked is called after the vault was unlocked, to start the work that
+// needs its key
+var VaultUnlocked = func() {}
+
+// vaultUnlock keeps concurrent unlocks from running the unlock work twice
+var vaultUnlock sync.Mutex
+
+// VaultUnlockHandler opens the vault with the master passphrase
+func VaultUnlockHandler(c echo.Context) error {
+	vaultUnlock.Lock()
+	defer vaultUnlock.Unlock()
+
+	if !vault.Enabled() {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Vault mode is not enabled"})
+	}
+	if vault.Unlocked() {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Vault already unlocked"})
+	}
+
+	release, err := checkThrottle(c, ThrottleScopeVault, 0, "")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = vault.Unlock(c.FormValue("passphrase"))
+	switch {
+	case errors.Is(err, vault.ErrWrongPassphrase):
+		recordFailedAttempt(c, ThrottleScopeVault, 0)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Wrong vault passphrase"})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to unlock vault"})
+	}
+	recordSuccessfulAttempt(c, ThrottleScopeVault, 0)
+
+	// Legacy locked notes could not be read while the vault was locked
+	if err := EncryptLegacyLockedNotes(); err != nil {
+		log.Printf("Failed to encrypt legacy locked notes: %v", err)
+	}
+
+	VaultUnlocked()
+	return c.JSON(http.StatusOK, map[string]string{"message": "Vault unlocked"})
+}
+
+// RequireUnlockedVault rejects every request but the health check and the unlock
+// endpoint while the vault is locked
+func RequireUnlockedVault(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !vault.Unlocked() && !lockedVaultRoutes[c.Path()] {
+			return c.JSON(http.StatusLocked, map[string]string{"error": "Vault is locked"})
+		}
+		return next(c)
+	}
+}
+
+// vaultState describes the vault for the health check
+func vaultState() string {
+	switch {
+	case !vault.Enabled():
+		return "disabled"
+	case vault.Unlocked():
+		return "unlocked"
+	}
+	return "locked"
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"yana-back/models"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// errVersionConflict aborts a save that lost the race against another save of the note
+var errVersionConflict = errors.New("note was saved concurrently")
+
+// setNoteETag exposes the note's version as its entity tag
+func setNoteETag(c echo.Context, note models.Note) {
+	c.Response().Header().Set("ETag", strconv.Quote(strconv.Itoa(note.Version)))
+}
+
+// checkNoteVersion rejects a save based on an older version of the note. Clients send
+// the version they edited in If-Match or the version field; saves without one always
+// go through.
+func checkNoteVersion(c echo.Context, note models.Note, input noteInput) error {
+	expected, err := expectedNoteVersion(c, input)
+	if err != nil {
+		return err
+	}
+
+	if expected == nil || note.ID == 0 || *expected == note.Version {
+		return nil
+	}
+	return noteConflict(c, note.ID, note.UserId)
+}
+
+// bumpNoteVersion claims the next version of the note inside the save's transaction,
+// failing with errVersionConflict if another save claimed it first
+func bumpNoteVersion(tx *gorm.DB, note *models.Note) error {
+	if note.ID == 0 {
+		note.Version = 1
+		return nil
+	}
+
+	result := tx.Model(&models.Note{}).
+		Where("id = ? AND version = ?", note.ID, note.Version).
+		UpdateColumn("version", note.Version+1)
+	if result.Error != nil {
+		log.Printf("Failed to update note version: %v", result.Error)
+		return jsonError(http.StatusInternalServerError, "Failed to save note")
+	}
+	if result.RowsAffected == 0 {
+		return errVersionConflict
+	}
+
+	note.Version++
+	return nil
+}
+
+// noteConflict answers 409 with the server's current copy of the note, so the client
+// can merge; the copy is only complete if the client may open the note
+func noteConflict(c echo.Context, noteID, userID uint) error {
+	var current models.Note
+	if err := DB.Scopes(ownedBy(userID)).Preload("Documents", byPosition).First(&current, noteID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return jsonError(http.StatusNotFound, "Note not found")
+		}
+		return jsonError(http.StatusInternalServerError, "Failed to fetch note")
+	}
+
+	unlocked := false
+	if key, err := requireNoteAccess(current, userID); err == nil {
+		unlocked = openNote(&current, key) == nil
+	}
+
+	setNoteETag(c, current)
+	return echo.NewHTTPError(http.StatusConflict, map[string]interface{}{
+		"error": "The note was changed since it was loaded",
+		"note":  buildNoteResponse(current, unlocked),
+	})
+}
+
+// Helper functions
+
+// expectedNoteVersion reads If-Match, falling back to the version field; nil when
+// neither was sent or If-Match is "*"
+func expectedNoteVersion(c echo.Context, input noteInput) (*int, error) {
+	ifMatch := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if ifMatch == "" {
+		return input.Version, nil
+	}
+	if ifMatch == "*" {
+		return nil, nil
+	}
+
+	// Only the first tag counts, a note has a single current version
+	tag := strings.TrimSpace(strings.Split(ifMatch, ",")[0])
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+
+	version, err := strconv.Atoi(tag)
+	if err != nil {
+		return nil, jsonError(http.StatusBadRequest, "Invalid If-Match header")
+	}
+	return &version, nil
+}
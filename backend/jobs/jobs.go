@@ -0,0 +1,126 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Scheduler runs background jobs until it is stopped. Jobs receive a context that is
+// cancelled on Stop and should return soon after.
+type Scheduler struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// stopped turns jobs added during or after Stop away
+	mu      sync.Mutex
+	stopped bool
+}
+
+// Job is the work done on each run
+type Job func(ctx context.Context) error
+
+// Sequence returns a job running the given jobs one after the other, stopping at the
+// first error
+func Sequence(jobs ...Job) Job {
+	return func(ctx context.Context) error {
+		for _, job := range jobs {
+			if err := job(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func New() *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{ctx: ctx, cancel: cancel}
+}
+
+// Every runs job every interval, starting one interval from now. A run that is still
+// going when the next one is due delays it rather than overlapping.
+func (s *Scheduler) Every(name string, interval time.Duration, job Job) {
+	if !s.add() {
+		return
+	}
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.run(name, job)
+			}
+		}
+	}()
+}
+
+// Go runs job once in the background; once the scheduler is stopped it does nothing
+func (s *Scheduler) Go(name string, job Job) {
+	if !s.add() {
+		return
+	}
+	go func() {
+		defer s.wg.Done()
+		s.run(name, job)
+	}()
+}
+
+// Stop cancels the jobs and waits for running ones to return, or for ctx to expire
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Helper functions
+
+// add counts a new job unless the scheduler is stopped
+func (s *Scheduler) add() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Scheduler) run(name string, job Job) {
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %s panicked: %v", name, r)
+		}
+	}()
+
+	if err := job(s.ctx); err != nil {
+		log.Printf("Job %s failed: %v", name, err)
+	}
+}
@@ -0,0 +1,104 @@
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FileName = "yana.lock"
+)
+
+var ErrLocked = errors.New("data directory is locked by another instance")
+
+// Lock is an exclusive, OS-level lock on a data directory. The operating system
+// drops it when the holding process dies, so a lock file left behind by a crash is
+// simply taken over.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes the lock of dataDir or fails with ErrLocked when another live
+// instance holds it
+func Acquire(dataDir string) (*Lock, error) {
+	path := filepath.Join(dataDir, FileName)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file); err != nil {
+		holder := readHolder(file)
+		file.Close()
+		if holder != "" {
+			return nil, fmt.Errorf("%w (held by %s)", ErrLocked, holder)
+		}
+		return nil, ErrLocked
+	}
+
+	if holder := readHolder(file); holder != "" {
+		log.Printf("Recovered stale lock left by %s", holder)
+	}
+
+	if err := writeHolder(file); err != nil {
+		unlockFile(file)
+		file.Close()
+		return nil, err
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release drops the lock. The lock file stays: removing it would let one instance
+// lock a fresh file at the path while another still holds the old one. It is only
+// emptied, so the next instance does not report a stale lock.
+func (l *Lock) Release() error {
+	l.file.Truncate(0)
+
+	if err := unlockFile(l.file); err != nil {
+		l.file.Close()
+		return fmt.Errorf("failed to unlock: %w", err)
+	}
+	return l.file.Close()
+}
+
+// Helper functions
+
+// readHolder describes the process recorded in the lock file, if any
+func readHolder(file *os.File) string {
+	raw := make([]byte, 128)
+	n, _ := file.ReadAt(raw, 0)
+
+	fields := strings.Fields(string(raw[:n]))
+	if len(fields) == 0 {
+		return ""
+	}
+	if _, err := strconv.Atoi(fields[0]); err != nil {
+		return ""
+	}
+
+	holder := "process " + fields[0]
+	if len(fields) > 1 {
+		holder += " started at " + fields[1]
+	}
+	return holder
+}
+
+func writeHolder(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate lock file: %w", err)
+	}
+
+	content := fmt.Sprintf("%d %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	if _, err := file.WriteAt([]byte(content), 0); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	return file.Sync()
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
-	"path/filepath"
+	"yana-back/backup"
+	"yana-back/blobstore"
+	"yana-back/config"
+	"yana-back/crypt"
 	"yana-back/handlers"
-	"yana-back/models"
+	"yana-back/jobs"
+	"yana-back/lockfile"
+	"yana-back/migrations"
 	"yana-back/routes"
+	"yana-back/thumbnail"
+	"yana-back/vault"
 
 	"os"
 
@@ -14,36 +25,177 @@ import (
 )
 
 func main() {
-	// Expect data dir path as first CLI argument
-	if len(os.Args) < 2 {
-		log.Fatal("No data directory provided")
+	// Maintenance commands, e.g. `yana-back vault init <data dir>` or `yana-back backup create <data dir>`
+	if len(os.Args) > 1 && os.Args[1] == "vault" {
+		runVaultCommand(os.Args[2:])
+		return
 	}
-	dataDir := os.Args[1]
-	log.Printf("Using data directory: %s", dataDir)
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		runBackupCommand(os.Args[2:])
+		return
+	}
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
+}
+
+// run serves the API until shutdown, releasing everything it acquired on the way out
+func run() error {
+	// Data dir path comes as first CLI argument, see config.Load for the other settings
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	log.Printf("Using data directory: %s", cfg.DataDir)
+
+	// Only one backend may use a data directory at a time
+	lock, err := lockDataDir(cfg)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if handlers.LaunchSecret, err = launchSecret(cfg.Secret); err != nil {
+		return err
+	}
+	handlers.Uploads = handlers.UploadLimits{
+		MaxFileSize:  cfg.MaxFileSize,
+		UserQuota:    cfg.UserQuota,
+		AllowedTypes: cfg.AllowedTypes,
+	}
+	handlers.TrashRetention = cfg.TrashRetention()
+
+	if err := openDatabase(cfg); err != nil {
+		return err
+	}
+	defer closeDatabase()
+
+	if err := openBlobStore(cfg); err != nil {
+		return err
+	}
+
+	if vault.Enabled() {
+		log.Println("Vault mode enabled, waiting for the master passphrase")
+	}
+
+	handlers.Backups = newBackupManager(cfg, handlers.DB)
+
+	// Background jobs
+	scheduler := jobs.New()
+	scheduler.Every("prune-note-grants", handlers.NoteUnlockTTL, handlers.PruneNoteGrants)
+	scheduler.Every("collect-garbage", handlers.GarbageCollectionInterval, handlers.CollectGarbage)
+	scheduler.Every("purge-trash", handlers.TrashPurgeInterval, handlers.PurgeTrash)
+	scheduler.Every("backup", backup.CheckInterval, handlers.Backups.Scheduled)
+	// Blob maintenance needs the vault key, so in vault mode it runs after unlocking
+	maintainBlobs := jobs.Sequence(handlers.MoveBlobsOutOfDatabase, handlers.SealBlobsWithVault, handlers.DeduplicateBlobs)
+	scheduler.Go("maintain-blobs", maintainBlobs)
+	handlers.VaultUnlocked = func() {
+		scheduler.Go("maintain-blobs", maintainBlobs)
+	}
+
+	// Start Echo server
+	e, err := routes.InitEcho(cfg)
+	if err != nil {
+		scheduler.Stop(context.Background())
+		return err
+	}
+
+	serveErr := serve(e)
+	shutdown(e, scheduler)
+	return serveErr
+}
 
+// newBackupManager snapshots the data directory of cfg into its backup directory
+func newBackupManager(cfg config.Config, db *gorm.DB) *backup.Manager {
+	retention := backup.Retention{Daily: cfg.BackupDaily, Weekly: cfg.BackupWeekly, Monthly: cfg.BackupMonthly}
+	return backup.New(cfg.BackupPath(), retention, backup.Source{
+		DB:             db,
+		AttachmentPath: cfg.AttachmentPath(),
+		DataDir:        cfg.DataDir,
+	})
+}
+
+// launchSecret returns the configured secret; without one, a secret is generated and
+// printed for the launcher to pick up
+func launchSecret(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+
+	raw, err := crypt.RandomBytes(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate launch secret: %w", err)
+	}
+	secret := hex.EncodeToString(raw)
+
+	log.Printf("No launch secret provided, generated one")
+	fmt.Printf("YANA_BACK_SECRET=%s\n", secret)
+	return secret, nil
+}
+
+// lockDataDir creates the data directory if needed and takes its instance lock
+func lockDataDir(cfg config.Config) (*lockfile.Lock, error) {
 	// Ensure directory exists
-	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
-		log.Fatalf("Failed to create directory: %v", err)
+	if err := os.MkdirAll(cfg.DataDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	lock, err := lockfile.Acquire(cfg.DataDir)
+	if errors.Is(err, lockfile.ErrLocked) {
+		return nil, fmt.Errorf("%s is already used by a running Yana backend, close it first: %w", cfg.DataDir, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock data directory: %w", err)
+	}
+	return lock, nil
+}
+
+// openDatabase opens and migrates the SQLite database of a locked data directory
+func openDatabase(cfg config.Config) error {
+	if err := vault.Load(cfg.DataDir); err != nil {
+		return fmt.Errorf("failed to load vault: %w", err)
 	}
 
-	// Construct full DB path
-	dbPath := filepath.Join(dataDir, "yana-db.sqlite")
+	dbPath := cfg.DatabasePath()
 
 	// Initialize SQLite database
 	var err error
 	handlers.DB, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	// Run migrations
-	err = handlers.DB.AutoMigrate(&models.User{}, &models.Note{}, &models.Document{})
-	if err != nil {
-		log.Fatalf("Failed to migrate database: %v", err)
+	if err := migrations.Run(handlers.DB, dbPath); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
 	}
 
 	log.Printf("Database initialized at %s", dbPath)
+	return nil
+}
 
-	// Start Echo server
-	routes.InitEcho()
+// openBlobStore opens the directories that keep attachment and profile picture
+// contents and their thumbnails, reconciles them with the database's references and
+// encrypts the notes locked before encryption at rest existed
+func openBlobStore(cfg config.Config) error {
+	store, err := blobstore.NewFileStore(cfg.AttachmentPath())
+	if err != nil {
+		return fmt.Errorf("failed to open blob store: %w", err)
+	}
+	handlers.Blobs = store
+
+	handlers.Thumbnails, err = thumbnail.NewCache(cfg.ThumbnailPath())
+	if err != nil {
+		return err
+	}
+
+	if err := handlers.CountBlobReferences(); err != nil {
+		return fmt.Errorf("failed to count blob references: %w", err)
+	}
+
+	if err := handlers.EncryptLegacyLockedNotes(); err != nil {
+		return fmt.Errorf("failed to encrypt locked notes: %w", err)
+	}
+	return nil
 }
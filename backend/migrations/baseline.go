@@ -0,0 +1,125 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The models as they were when versioned migrations were introduced, frozen so the
+// baseline step creates the same schema whatever the models become. Only what shapes
+// the schema is kept: no serializers, hooks or fields GORM ignores.
+
+type user struct {
+	ID                uint   `gorm:"primaryKey"`
+	Name              string `gorm:"type:text"`
+	NickName          string `gorm:"type:text"`
+	Language          string `gorm:"type:text"`
+	Password          string `gorm:"type:text"`
+	Hint              string `gorm:"type:text"`
+	ProfilePictureKey string `gorm:"not null;default:'';index"`
+	ProfilePicture    []byte `gorm:"type:blob"`
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+type note struct {
+	ID             int       `gorm:"primaryKey"`
+	UserId         uint      `gorm:"not null"`
+	User           user      `gorm:"foreignKey:UserId;references:ID"`
+	Content        string    `gorm:"type:text"`
+	Title          string    `gorm:"type:text"`
+	Password       string    `gorm:"type:text"`
+	KeySalt        []byte    `gorm:"type:blob"`
+	TitleEncrypted bool      `gorm:"not null;default:false"`
+	Tag            string    `gorm:"type:text"`
+	Mood           string    `gorm:"type:text"`
+	FColor         string    `gorm:"type:text"`
+	BColor         string    `gorm:"type:text"`
+	BPicture       *document `gorm:"foreignKey:BPictureId"`
+	BPictureId     *uint
+	Documents      []document
+	Version        int `gorm:"not null;default:1"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	DeletedAt      gorm.DeletedAt `gorm:"index"`
+}
+
+type document struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserId    uint   `gorm:"not null"`
+	User      user   `gorm:"foreignKey:UserId;references:ID"`
+	NoteId    int    `gorm:"not null"`
+	Name      string `gorm:"type:text"`
+	Type      *string
+	BlobKey   string `gorm:"not null;default:'';index"`
+	Size      int64  `gorm:"not null;default:0"`
+	Data      []byte `gorm:"type:blob"`
+	Encrypted bool   `gorm:"not null;default:false"`
+	Position  int    `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type noteRevision struct {
+	ID             uint               `gorm:"primaryKey"`
+	NoteId         int                `gorm:"not null;index"`
+	UserId         uint               `gorm:"not null"`
+	Version        int                `gorm:"not null"`
+	Title          string             `gorm:"type:text"`
+	Content        string             `gorm:"type:text"`
+	Tag            string             `gorm:"type:text"`
+	Mood           string             `gorm:"type:text"`
+	TitleEncrypted bool               `gorm:"not null;default:false"`
+	Encrypted      bool               `gorm:"not null;default:false"`
+	Documents      []revisionDocument `gorm:"foreignKey:RevisionId"`
+	CreatedAt      time.Time
+}
+
+type revisionDocument struct {
+	ID         uint   `gorm:"primaryKey"`
+	RevisionId uint   `gorm:"not null;index"`
+	Name       string `gorm:"type:text"`
+	Type       *string
+	BlobKey    string `gorm:"not null;default:'';index"`
+	Size       int64  `gorm:"not null;default:0"`
+	Encrypted  bool   `gorm:"not null;default:false"`
+	Position   int    `gorm:"not null;default:0"`
+}
+
+type blob struct {
+	Key         string `gorm:"primaryKey"`
+	ContentHash string `gorm:"not null;default:'';index"`
+	Size        int64  `gorm:"not null;default:0"`
+	StoredSize  int64  `gorm:"not null;default:0"`
+	RefCount    int    `gorm:"not null;default:0"`
+	CreatedAt   time.Time
+}
+
+type authThrottle struct {
+	ID          uint   `gorm:"primaryKey"`
+	Scope       string `gorm:"type:text;not null;uniqueIndex:idx_auth_throttle_subject"`
+	SubjectID   uint   `gorm:"not null;uniqueIndex:idx_auth_throttle_subject"`
+	Failures    int    `gorm:"not null;default:0"`
+	LockedUntil *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type authEvent struct {
+	ID        uint   `gorm:"primaryKey"`
+	Scope     string `gorm:"type:text;not null;index:idx_auth_event_subject"`
+	SubjectID uint   `gorm:"not null;index:idx_auth_event_subject"`
+	Outcome   string `gorm:"type:text;not null"`
+	RemoteIP  string `gorm:"type:text"`
+	CreatedAt time.Time
+}
+
+type recoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserId    uint   `gorm:"not null;index"`
+	User      user   `gorm:"foreignKey:UserId;references:ID"`
+	CodeHash  string `gorm:"type:text;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,175 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrNewerSchema is returned for a database migrated by a newer backend
+var ErrNewerSchema = errors.New("database schema is newer than this backend")
+
+// Migration is one step of the schema's history. Steps run in order of Version, each
+// in its own transaction, and are never changed once released: a later change to the
+// schema is a new step.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied step
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// Steps is the schema's history
+var Steps = []Migration{
+	{1, "baseline", baseline},
+	{2, "index note and user references", indexReferences},
+	{3, "unsigned note IDs", unsignedNoteIDs},
+	{4, "user session epochs", sessionEpochs},
+}
+
+// Latest is the schema version this backend works with
+func Latest() int {
+	return Steps[len(Steps)-1].Version
+}
+
+// Run brings the database at dbPath up to the latest schema version. A database that
+// already holds data is backed up next to it first.
+func Run(db *gorm.DB, dbPath string) error {
+	return apply(db, Steps, func(version int) (string, error) {
+		return backup(db, dbPath, version)
+	})
+}
+
+// Version returns the schema version of the database, 0 if it was never migrated
+func Version(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+
+	var version int
+	err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// Helper functions
+
+// apply runs the steps the database has not seen yet, calling backup beforehand if
+// the database already holds data
+func apply(db *gorm.DB, steps []Migration, backup func(version int) (string, error)) error {
+	if err := checkSteps(steps); err != nil {
+		return err
+	}
+
+	current, err := Version(db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	latest := steps[len(steps)-1].Version
+	if current > latest {
+		return fmt.Errorf("%w: it has version %d, this backend supports up to %d", ErrNewerSchema, current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	// A database from before versioned migrations has tables but no version
+	if current > 0 || db.Migrator().HasTable(&user{}) {
+		path, err := backup(current)
+		if err != nil {
+			return fmt.Errorf("failed to back up database: %w", err)
+		}
+		log.Printf("Backed up the database to %s before migrating it", path)
+	}
+
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	for _, step := range steps {
+		if step.Version <= current {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := step.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: step.Version, Name: step.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", step.Version, step.Name, err)
+		}
+		log.Printf("Migrated database to version %d (%s)", step.Version, step.Name)
+	}
+	return nil
+}
+
+// checkSteps makes sure the steps are numbered 1, 2, 3...
+func checkSteps(steps []Migration) error {
+	if len(steps) == 0 {
+		return errors.New("no migrations")
+	}
+	for i, step := range steps {
+		if step.Version != i+1 {
+			return fmt.Errorf("migration %q has version %d, expected %d", step.Name, step.Version, i+1)
+		}
+	}
+	return nil
+}
+
+// backup writes a consistent copy of the database next to it, named after the schema
+// version it holds
+func backup(db *gorm.DB, dbPath string, version int) (string, error) {
+	path := fmt.Sprintf("%s.v%d-%s.bak", dbPath, version, time.Now().Format("20060102-150405"))
+	if err := db.Exec("VACUUM INTO ?", path).Error; err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// baseline is the schema as AutoMigrate left it before versioned migrations, see
+// baseline.go. Older databases are brought up to it the way they always were.
+func baseline(tx *gorm.DB) error {
+	return tx.AutoMigrate(&user{}, &note{}, &document{}, &noteRevision{}, &revisionDocument{}, &blob{},
+		&authThrottle{}, &authEvent{}, &recoveryCode{})
+}
+
+// indexReferences indexes the columns notes and attachments are looked up by
+func indexReferences(tx *gorm.DB) error {
+	statements := []string{
+		"CREATE INDEX IF NOT EXISTS idx_notes_user_id ON notes (user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_documents_user_id ON documents (user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_documents_note_id ON documents (note_id)",
+		"CREATE INDEX IF NOT EXISTS idx_note_revisions_user_id ON note_revisions (user_id)",
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsignedNoteIDs makes note IDs fit the uint they are read into. notes.id and
+// note_revisions.note_id only ever held row IDs; in documents.note_id background
+// pictures move from -1 to 0, and the few rows below that, which no note could ever
+// refer to, go along to be collected as garbage. SQLite stores int and uint alike as
+// integer, so the columns themselves stay.
+func unsignedNoteIDs(tx *gorm.DB) error {
+	return tx.Exec("UPDATE documents SET note_id = 0 WHERE note_id < 0").Error
+}
+
+// sessionEpochs adds the counter that ends a user's sessions when it goes up
+func sessionEpochs(tx *gorm.DB) error {
+	return tx.Exec("ALTER TABLE users ADD COLUMN session_epoch integer NOT NULL DEFAULT 0").Error
+}
@@ -0,0 +1,304 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"yana-back/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestApplyRunsStepsInOrder(t *testing.T) {
+	db := openTestDB(t)
+
+	var ran []int
+	if err := apply(db, recordingSteps(&ran, 3), noBackup(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran steps %v, want %v", ran, want)
+	}
+	checkVersion(t, db, 3)
+
+	var applied []SchemaMigration
+	if err := db.Order("version").Find(&applied).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 3 || applied[2].Name != "step 3" || applied[2].AppliedAt.IsZero() {
+		t.Errorf("recorded %+v", applied)
+	}
+}
+
+func TestApplySkipsAppliedSteps(t *testing.T) {
+	db := openTestDB(t)
+
+	var ran []int
+	if err := apply(db, recordingSteps(&ran, 2), noBackup(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	ran = nil
+	if err := apply(db, recordingSteps(&ran, 4), func(int) (string, error) { return "backup", nil }); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 4}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran steps %v, want %v", ran, want)
+	}
+
+	// Nothing left to do
+	ran = nil
+	if err := apply(db, recordingSteps(&ran, 4), noBackup(t)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) > 0 {
+		t.Errorf("ran steps %v again", ran)
+	}
+	checkVersion(t, db, 4)
+}
+
+func TestApplyBacksUpExistingDatabases(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(db *gorm.DB) error
+		want    []int
+	}{
+		{"new database", func(*gorm.DB) error { return nil }, nil},
+		{"unversioned database", func(db *gorm.DB) error { return db.AutoMigrate(&user{}) }, []int{0}},
+		{"versioned database", func(db *gorm.DB) error {
+			var ran []int
+			return apply(db, recordingSteps(&ran, 1), func(int) (string, error) { return "", nil })
+		}, []int{1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if err := test.prepare(db); err != nil {
+				t.Fatal(err)
+			}
+
+			var backedUp []int
+			var ran []int
+			err := apply(db, recordingSteps(&ran, 2), func(version int) (string, error) {
+				backedUp = append(backedUp, version)
+				return "backup", nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(backedUp, test.want) {
+				t.Errorf("backed up versions %v, want %v", backedUp, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyStopsWhenBackupFails(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&user{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []int
+	err := apply(db, recordingSteps(&ran, 2), func(int) (string, error) { return "", errors.New("disk full") })
+	if err == nil {
+		t.Fatal("migrated without a backup")
+	}
+	if len(ran) > 0 {
+		t.Errorf("ran steps %v without a backup", ran)
+	}
+	checkVersion(t, db, 0)
+}
+
+func TestApplyRefusesNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+
+	var ran []int
+	if err := apply(db, recordingSteps(&ran, 3), noBackup(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	ran = nil
+	err := apply(db, recordingSteps(&ran, 2), noBackup(t))
+	if !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("got %v, want ErrNewerSchema", err)
+	}
+	if len(ran) > 0 {
+		t.Errorf("ran steps %v on a newer schema", ran)
+	}
+	checkVersion(t, db, 3)
+}
+
+func TestApplyRollsBackFailedStep(t *testing.T) {
+	db := openTestDB(t)
+
+	var ran []int
+	steps := recordingSteps(&ran, 3)
+	steps[1].Up = func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE TABLE half_done (id integer)").Error; err != nil {
+			return err
+		}
+		return errors.New("step failed")
+	}
+
+	if err := apply(db, steps, noBackup(t)); err == nil {
+		t.Fatal("failed step did not fail the migration")
+	}
+	if want := []int{1}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran steps %v, want %v", ran, want)
+	}
+	if db.Migrator().HasTable("half_done") {
+		t.Error("failed step was not rolled back")
+	}
+	checkVersion(t, db, 1)
+}
+
+func TestApplyChecksStepNumbers(t *testing.T) {
+	db := openTestDB(t)
+
+	var ran []int
+	steps := recordingSteps(&ran, 3)
+	steps[2].Version = 4
+
+	if err := apply(db, steps, noBackup(t)); err == nil {
+		t.Fatal("misnumbered steps were applied")
+	}
+	if len(ran) > 0 {
+		t.Errorf("ran steps %v", ran)
+	}
+}
+
+func TestRunMigratesUnversionedDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "yana-db.sqlite")
+	db := openTestDBAt(t, dbPath)
+
+	// A database as AutoMigrate left it, with a background picture stored as note -1
+	if err := baseline(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&user{ID: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&document{UserId: 1, NoteId: -1}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Run(db, dbPath); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, Latest())
+
+	backups, err := filepath.Glob(dbPath + ".v0-*.bak")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("found backups %v: %v", backups, err)
+	}
+	if info, err := os.Stat(backups[0]); err != nil || info.Size() == 0 {
+		t.Errorf("backup is missing or empty: %v", err)
+	}
+
+	for _, index := range []string{"idx_notes_user_id", "idx_documents_user_id", "idx_documents_note_id", "idx_note_revisions_user_id"} {
+		var count int64
+		if err := db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", index).Scan(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			t.Errorf("index %s is missing", index)
+		}
+	}
+
+	var background models.Document
+	if err := db.Omit("data").First(&background).Error; err != nil {
+		t.Fatal(err)
+	}
+	if background.NoteId != 0 {
+		t.Errorf("background picture has note ID %d, want 0", background.NoteId)
+	}
+}
+
+// TestLatestSchemaMatchesModels catches model changes that lack a migration step
+func TestLatestSchemaMatchesModels(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "yana-db.sqlite")
+	db := openTestDBAt(t, dbPath)
+	if err := Run(db, dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated := schemaOf(t, db)
+	err := db.AutoMigrate(&models.User{}, &models.Note{}, &models.Document{}, &models.NoteRevision{},
+		&models.RevisionDocument{}, &models.Blob{}, &models.AuthThrottle{}, &models.AuthEvent{}, &models.RecoveryCode{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current := schemaOf(t, db); !reflect.DeepEqual(current, migrated) {
+		t.Errorf("the models differ from the migrated schema:\nmigrated %v\nmodels   %v", migrated, current)
+	}
+}
+
+// recordingSteps returns n steps that append their version to ran
+func recordingSteps(ran *[]int, n int) []Migration {
+	steps := make([]Migration, n)
+	for i := range steps {
+		version := i + 1
+		steps[i] = Migration{Version: version, Name: fmt.Sprintf("step %d", version), Up: func(tx *gorm.DB) error {
+			*ran = append(*ran, version)
+			return nil
+		}}
+	}
+	return steps
+}
+
+func noBackup(t *testing.T) func(int) (string, error) {
+	return func(version int) (string, error) {
+		t.Errorf("backed up a database at version %d that holds no data", version)
+		return "", nil
+	}
+}
+
+func checkVersion(t *testing.T, db *gorm.DB, want int) {
+	t.Helper()
+	version, err := Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != want {
+		t.Errorf("schema version is %d, want %d", version, want)
+	}
+}
+
+// schemaOf lists the definitions of the tables and indexes of the database
+func schemaOf(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var definitions []string
+	err := db.Raw("SELECT type || ' ' || name || ': ' || COALESCE(sql, '') FROM sqlite_master ORDER BY type, name").
+		Scan(&definitions).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return definitions
+}
+
+func openTestDB(t *testing.T) *gorm.DB {
+	return openTestDBAt(t, filepath.Join(t.TempDir(), "test.sqlite"))
+}
+
+func openTestDBAt(t *testing.T, path string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
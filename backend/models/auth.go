@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// AuthThrottle tracks consecutive failed password attempts against a user, a note or
+// the vault
+type AuthThrottle struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	Scope       string     `gorm:"type:text;not null;uniqueIndex:idx_auth_throttle_subject" json:"scope"`
+	SubjectID   uint       `gorm:"not null;uniqueIndex:idx_auth_throttle_subject" json:"subjectId"`
+	Failures    int        `gorm:"not null;default:0" json:"failures"`
+	LockedUntil *time.Time `json:"lockedUntil"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt   time.Time  `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+// AuthEvent records a single login or note unlock attempt
+type AuthEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Scope     string    `gorm:"type:text;not null;index:idx_auth_event_subject" json:"scope"`
+	SubjectID uint      `gorm:"not null;index:idx_auth_event_subject" json:"subjectId"`
+	Outcome   string    `gorm:"type:text;not null" json:"outcome"`
+	RemoteIP  string    `gorm:"type:text" json:"remoteIp"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// Blob is a file content in the blob store. Attachments and profile pictures with
+// the same content share one blob, RefCount counts the rows that refer to it.
+type Blob struct {
+	Key string `gorm:"primaryKey" json:"key"`
+	// ContentHash identifies the content before it is encrypted with the vault key;
+	// empty for attachments of locked notes, which are never shared
+	ContentHash string    `gorm:"not null;default:'';index" json:"-"`
+	Size        int64     `gorm:"not null;default:0" json:"size"`
+	StoredSize  int64     `gorm:"not null;default:0" json:"storedSize"`
+	RefCount    int       `gorm:"not null;default:0" json:"refCount"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
@@ -5,13 +5,21 @@ import (
 )
 
 type Document struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	UserId    uint      `gorm:"not null" json:"user_id"`
-	User      User      `gorm:"foreignKey:UserId;references:ID"`
-	NoteId    int      `gorm:"not null" json:"noteId"`
-	Name      string    `json:"name"`
-	Type      *string
-	Data      []byte    `gorm:"type:blob" json:"data"`
+	ID     uint `gorm:"primaryKey" json:"id"`
+	UserId uint `gorm:"not null" json:"user_id"`
+	User   User `gorm:"foreignKey:UserId;references:ID"`
+	// NoteId is 0 for background pictures, their note refers to them instead
+	NoteId uint   `gorm:"not null" json:"noteId"`
+	Name   string `gorm:"type:text;serializer:vault" json:"name"`
+	Type   *string
+	// BlobKey names the content in the blob store; Data only holds content stored
+	// before the blob store existed
+	BlobKey   string `gorm:"not null;default:'';index" json:"-"`
+	Size      int64  `gorm:"not null;default:0" json:"size"`
+	Data      []byte `gorm:"type:blob;serializer:vault" json:"-"`
+	Encrypted bool   `gorm:"not null;default:false" json:"-"`
+	// Position orders the attachments of a note
+	Position  int       `gorm:"not null;default:0" json:"position"`
 	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
 	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
 }
@@ -4,27 +4,45 @@ import (
 	"gorm.io/gorm"
 
 	"time"
+
+	_ "yana-back/vault" // registers the vault serializer used by the tags below
 )
 
 type Note struct {
-	ID         int      `gorm:"primaryKey" form:"id"`
-	UserId     uint      `gorm:"not null" form:"user_id"`
-	User       User      `gorm:"foreignKey:UserId;references:ID"`
-	Content    string    `gorm:"type:text" form:"content"`
-	Title      string    `gorm:"type:text" form:"title"`
-	Password   string    `gorm:"type:text" form:"password"`
-	Tag        string    `gorm:"type:text" form:"tag"`
-	Mood       string    `gorm:"type:text" form:"mood"`
-	FColor     string    `gorm:"type:text" form:"fColor"`
-	BColor     string    `gorm:"type:text" form:"bColor"`
-	BPicture   *Document `gorm:"foreignKey:BPictureId"`
-	BPictureId *uint     `form:"bpicture_id"`
-	Documents  []Document
-	CreatedAt  time.Time `gorm:"autoCreateTime" form:"createdAt"`
-	UpdatedAt  time.Time `gorm:"autoUpdateTime" form:"updatedAt"`
+	ID             uint      `gorm:"primaryKey" form:"id"`
+	UserId         uint      `gorm:"not null" form:"user_id"`
+	User           User      `gorm:"foreignKey:UserId;references:ID"`
+	Content        string    `gorm:"type:text;serializer:vault" form:"content"`
+	Title          string    `gorm:"type:text;serializer:vault" form:"title"`
+	Password       string    `gorm:"type:text" form:"password" json:"-"`
+	KeySalt        []byte    `gorm:"type:blob" json:"-"`
+	TitleEncrypted bool      `gorm:"not null;default:false" json:"-"`
+	Tag            string    `gorm:"type:text;serializer:vault" form:"tag"`
+	Mood           string    `gorm:"type:text;serializer:vault" form:"mood"`
+	FColor         string    `gorm:"type:text" form:"fColor"`
+	BColor         string    `gorm:"type:text" form:"bColor"`
+	BPicture       *Document `gorm:"foreignKey:BPictureId"`
+	BPictureId     *uint     `form:"bpicture_id"`
+	Documents      []Document
+	// Version is bumped by every save, so stale saves can be detected
+	Version   int       `gorm:"not null;default:1" json:"version"`
+	CreatedAt time.Time `gorm:"autoCreateTime" form:"createdAt"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" form:"updatedAt"`
+	// DeletedAt is set while the note is in the trash
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deletedAt"`
 }
 
 func (n *Note) BeforeUpdate(tx *gorm.DB) (err error) {
 	n.UpdatedAt = time.Now()
 	return nil
 }
+
+// IsLocked reports whether the note is protected by a password
+func (n *Note) IsLocked() bool {
+	return n.Password != ""
+}
+
+// IsEncrypted reports whether the note's content and attachments are encrypted at rest
+func (n *Note) IsEncrypted() bool {
+	return n.IsLocked() && len(n.KeySalt) > 0
+}
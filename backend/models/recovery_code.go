@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// RecoveryCode is a one-time code that resets a user's password without the old one
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserId    uint       `gorm:"not null;index" json:"userId"`
+	User      User       `gorm:"foreignKey:UserId;references:ID" json:"-"`
+	CodeHash  string     `gorm:"type:text;not null" json:"-"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+}
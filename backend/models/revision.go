@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+)
+
+// NoteRevision is a note as one of its saves left it. The revisions of a locked note
+// are encrypted with the note's key, like the note itself.
+type NoteRevision struct {
+	ID             uint               `gorm:"primaryKey" json:"id"`
+	NoteId         uint               `gorm:"not null;index" json:"noteId"`
+	UserId         uint               `gorm:"not null" json:"-"`
+	Version        int                `gorm:"not null" json:"version"`
+	Title          string             `gorm:"type:text;serializer:vault" json:"title"`
+	Content        string             `gorm:"type:text;serializer:vault" json:"content"`
+	Tag            string             `gorm:"type:text;serializer:vault" json:"tag"`
+	Mood           string             `gorm:"type:text;serializer:vault" json:"mood"`
+	TitleEncrypted bool               `gorm:"not null;default:false" json:"-"`
+	Encrypted      bool               `gorm:"not null;default:false" json:"-"`
+	Documents      []RevisionDocument `gorm:"foreignKey:RevisionId" json:"documents"`
+	CreatedAt      time.Time          `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// RevisionDocument is an attachment of a revision. It refers to the attachment's
+// blob rather than copying it.
+type RevisionDocument struct {
+	ID         uint    `gorm:"primaryKey" json:"-"`
+	RevisionId uint    `gorm:"not null;index" json:"-"`
+	Name       string  `gorm:"type:text;serializer:vault" json:"name"`
+	Type       *string `json:"type"`
+	BlobKey    string  `gorm:"not null;default:'';index" json:"-"`
+	Size       int64   `gorm:"not null;default:0" json:"size"`
+	Encrypted  bool    `gorm:"not null;default:false" json:"-"`
+	Position   int     `gorm:"not null;default:0" json:"position"`
+}
@@ -8,20 +8,37 @@ import (
 
 // User model represents the user table
 type User struct {
-	ID             uint      `gorm:"primaryKey" json:"id"`
-	Name           string    `gorm:"type:text" json:"name"`
-	NickName       string    `gorm:"type:text" json:"nickName"`
-	Language       string    `gorm:"type:text" json:"language"`
-	Password       string    `gorm:"type:text" json:"password"`
-	Hint           string    `gorm:"type:text" json:"hint"`
-	ProfilePicture []byte    `gorm:"type:blob" json:"profilePicture"`
-	CreatedAt      time.Time `gorm:"autoCreateTime" json:"createdAt"`
-	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	Name        string `gorm:"type:text;serializer:vault" json:"name"`
+	NickName    string `gorm:"type:text;serializer:vault" json:"nickName"`
+	Language    string `gorm:"type:text" json:"language"`
+	Password    string `gorm:"type:text" json:"-"`
+	HasPassword bool   `gorm:"-" json:"hasPassword"`
+	Hint        string `gorm:"type:text;serializer:vault" json:"hint"`
+	// ProfilePictureKey names the picture in the blob store; ProfilePicture only holds
+	// pictures stored before the blob store existed
+	ProfilePictureKey string `gorm:"not null;default:'';index" json:"-"`
+	ProfilePicture    []byte `gorm:"type:blob;serializer:vault" json:"-"`
+	// SessionEpoch is counted up to end every session issued before
+	SessionEpoch int       `gorm:"not null;default:0" json:"-"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
 }
 
-
 // BeforeUpdate GORM hook to update the UpdatedAt field
 func (u *User) BeforeUpdate(tx *gorm.DB) (err error) {
 	u.UpdatedAt = time.Now() // Set UpdatedAt to current time before update
 	return nil
 }
+
+// AfterFind GORM hook to expose whether a password is set without leaking its hash
+func (u *User) AfterFind(tx *gorm.DB) (err error) {
+	u.HasPassword = u.Password != ""
+	return nil
+}
+
+// AfterSave GORM hook to keep HasPassword in sync after create or update
+func (u *User) AfterSave(tx *gorm.DB) (err error) {
+	u.HasPassword = u.Password != ""
+	return nil
+}
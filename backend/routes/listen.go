@@ -0,0 +1,45 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"yana-back/config"
+)
+
+// listen opens the configured address, falling back to a free port when the
+// configured one is taken and AutoPort is enabled
+func listen(cfg config.Config) (net.Listener, error) {
+	if ip := net.ParseIP(cfg.ListenAddress); ip == nil || !ip.IsLoopback() {
+		log.Printf("Warning: listening on %s exposes the backend beyond this machine", cfg.ListenAddress)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(cfg.ListenAddress, strconv.Itoa(cfg.Port)))
+	if err != nil && cfg.AutoPort && cfg.Port != 0 {
+		log.Printf("Port %d is unavailable (%v), picking a free one", cfg.Port, err)
+		listener, err = net.Listen("tcp", net.JoinHostPort(cfg.ListenAddress, "0"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	return listener, nil
+}
+
+// reportPort tells the launcher which port was chosen, on stdout and in the port file
+func reportPort(cfg config.Config, listener net.Listener) error {
+	port := listener.Addr().(*net.TCPAddr).Port
+	fmt.Printf("YANA_PORT=%d\n", port)
+
+	path := cfg.PortFilePath()
+	if path == "" {
+		return nil
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(port)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write port file: %w", err)
+	}
+	return nil
+}
@@ -2,45 +2,106 @@ package routes
 
 import (
 	"net/http"
+	"yana-back/config"
 	"yana-back/handlers"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-func InitEcho() {
+// AppOrigins are the origins the Tauri webview loads the app from, plus the Vite dev server
+var AppOrigins = []string{
+	"tauri://localhost",
+	"http://tauri.localhost",
+	"https://tauri.localhost",
+	"http://localhost:1420",
+}
+
+// logFormat is Echo's default request log line with the path in place of the URI: the
+// launch secret and session token may come in the query string and must not be logged
+const logFormat = `{"time":"${time_rfc3339_nano}","id":"${id}","remote_ip":"${remote_ip}",` +
+	`"host":"${host}","method":"${method}","path":"${path}","user_agent":"${user_agent}",` +
+	`"status":${status},"error":"${error}","latency":${latency},"latency_human":"${latency_human}"` +
+	`,"bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n"
+
+// InitEcho sets up the routes and opens the listener; the caller starts serving with
+// e.Start("") and stops with e.Shutdown
+func InitEcho(cfg config.Config) (*echo.Echo, error) {
 	e := echo.New()
 
-	// Enable CORS for specific origins
+	// Enable CORS for the app's own origins only
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins:  []string{"*"},
+		AllowOrigins:  AppOrigins,
 		AllowMethods:  []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
-		AllowHeaders:  []string{"Content-Disposition", "Content-Type", "Authorization"},
-		ExposeHeaders: []string{"Content-Disposition"},
+		AllowHeaders:  []string{"Content-Disposition", "Content-Type", "Authorization", "If-Match", "If-None-Match", "If-Modified-Since", "If-Range", "Range", handlers.LaunchSecretHeader},
+		ExposeHeaders: []string{"Content-Disposition", "ETag", "Last-Modified", "Accept-Ranges", "Content-Range"},
 	}))
-	e.Use(middleware.Logger())
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Format: logFormat}))
+	e.Use(handlers.RequireLaunchSecret)
+	e.Use(handlers.RequireUnlockedVault)
+	e.Use(handlers.RequireSession)
+	e.Use(handlers.LimitRequestSize(cfg.MaxRequestSize))
+
+	// Health check route, also telling the client whether the vault must be unlocked
+	e.GET("/health", handlers.HealthHandler)
 
-	// Health check route (defined inline)
-	e.GET("/health", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, map[string]string{
-			"status": "ok",
-		})
-	})
+	// Vault routes
+	e.POST("/vault/unlock", handlers.VaultUnlockHandler)
+
+	// Session routes
+	e.POST("/login", handlers.LoginHandler)
+	e.POST("/signup", handlers.SignupHandler)
+
+	// Password routes
+	e.POST("/user/password", handlers.ChangePasswordHandler)
+	e.POST("/user/password/set", handlers.SetPasswordHandler)
+	e.POST("/user/password/remove", handlers.RemovePasswordHandler)
+	e.POST("/user/password/recover", handlers.RecoverPasswordHandler)
 
 	// API routes
 	e.POST("/save-user", handlers.SaveUserHandler)
 	e.GET("/user/:id", handlers.GetUserByIDHandler)
 	e.GET("/user/:id/profile-picture", handlers.GetUserProfilePictureHandler)
+	e.GET("/user/:id/profile-picture/thumbnail", handlers.GetProfilePictureThumbnailHandler)
 	e.POST("/yana-back-down", handlers.YanaBackDownHandler)
+	e.POST("/maintenance/gc", handlers.CollectGarbageHandler)
+	e.POST("/maintenance/backup", handlers.CreateBackupHandler)
+	e.GET("/maintenance/backups", handlers.GetBackupsHandler)
 	e.PUT("/note", handlers.SaveNoteHandler)
 	e.GET("/note/:id", handlers.GetNoteHandler)
+	e.PATCH("/note/:id", handlers.PatchNoteHandler)
+	e.POST("/note/:id/unlock", handlers.UnlockNoteHandler)
+	e.GET("/note/:id/revisions", handlers.GetNoteRevisionsHandler)
+	e.GET("/note/:id/revisions/diff", handlers.GetNoteRevisionDiffHandler)
+	e.GET("/note/:id/revisions/:revision", handlers.GetNoteRevisionHandler)
+	e.POST("/note/:id/revisions/:revision/restore", handlers.RestoreNoteRevisionHandler)
+	e.GET("/documents/storage-stat", handlers.GetStorageStatsHandler)
 	e.GET("/documents/:id", handlers.GetDocument)
+	e.GET("/documents/:id/thumbnail", handlers.GetDocumentThumbnailHandler)
+	e.PATCH("/documents/:id", handlers.RenameDocumentHandler)
+	e.DELETE("/documents/:id", handlers.DeleteDocumentHandler)
 	e.GET("/notes", handlers.GetFilteredNotesHandler)
 	e.GET("/notes/creation-stat", handlers.GetNotesCountByWeekdayHandler)
 	e.GET("/notes/mood-stat", handlers.GetNotesCountByMoodHandler)
 	e.DELETE("/notes/:id", handlers.DeleteNoteHandler)
 	e.GET("/notes/:id/documents/:documentName", handlers.GetNoteDocumentByName)
+	e.GET("/trash", handlers.GetTrashHandler)
+	e.POST("/trash/:id/restore", handlers.RestoreNoteHandler)
+	e.DELETE("/trash/:id", handlers.PurgeNoteHandler)
+	e.DELETE("/trash", handlers.EmptyTrashHandler)
+	e.POST("/notes/:id/documents", handlers.AddNoteDocumentsHandler)
+	e.PUT("/notes/:id/documents/order", handlers.ReorderNoteDocumentsHandler)
 	e.POST("/music", handlers.PlayPomodoroHandler)
-	// Start server
-	e.Logger.Fatal(e.Start(":8090"))
+
+	listener, err := listen(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := reportPort(cfg, listener); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	e.Listener = listener
+	return e, nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"yana-back/handlers"
+	"yana-back/jobs"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ShutdownTimeout bounds how long in-flight requests and running jobs may take to finish
+const ShutdownTimeout = 10 * time.Second
+
+// serve runs the server until it fails, a client calls /yana-back-down or the process
+// receives SIGINT or SIGTERM
+func serve(e *echo.Echo) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- e.Start("")
+	}()
+
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return fmt.Errorf("server failed: %w", err)
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	case <-handlers.ShutdownRequested():
+		log.Println("Shutting down the server...")
+	}
+	return nil
+}
+
+// shutdown stops accepting requests, lets in-flight ones and running jobs finish, then
+// returns so the database can be closed
+func shutdown(e *echo.Echo, scheduler *jobs.Scheduler) {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain requests: %v", err)
+	}
+
+	if err := scheduler.Stop(ctx); err != nil {
+		log.Printf("Failed to stop background jobs: %v", err)
+	}
+}
+
+// closeDatabase closes the database once nothing uses it anymore
+func closeDatabase() {
+	if handlers.DB == nil {
+		return
+	}
+
+	sqlDB, err := handlers.DB.DB()
+	if err != nil {
+		log.Printf("Failed to get database handle: %v", err)
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package thumbnail
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Cache keeps rendered thumbnails as files named after the key of their source and
+// their size. Sources are never changed in place, a changed source has a new key.
+type Cache struct {
+	dir string
+}
+
+// NewCache opens the cache directory, creating it if needed, and clears files left
+// over from an interrupted write
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	return &Cache{dir: dir}, nil
+}
+
+// Open returns the cached thumbnail, an error satisfying os.IsNotExist if there is none
+func (c *Cache) Open(key string, size int) (*os.File, error) {
+	path, err := c.path(key, size)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Store caches the thumbnail written by write
+func (c *Cache) Store(key string, size int, write func(w io.Writer) error) error {
+	path, err := c.path(key, size)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create thumbnail: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write thumbnail: %w", err)
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Delete removes every cached size of a source
+func (c *Cache) Delete(key string) error {
+	for _, size := range Sizes {
+		path, err := c.path(key, size)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete thumbnail: %w", err)
+		}
+	}
+	return nil
+}
+
+// Keys lists the sources that have cached thumbnails
+func (c *Cache) Keys() ([]string, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list thumbnails: %w", err)
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		key, _, ok := strings.Cut(entry.Name(), "-")
+		if ok && validKey(key) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Helper functions
+
+func (c *Cache) path(key string, size int) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("invalid thumbnail key %q", key)
+	}
+	return filepath.Join(c.dir, key+"-"+strconv.Itoa(size)), nil
+}
+
+// validKey accepts the hex keys of the blob store, which are safe as file names
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	// Decoders for the formats thumbnails are made of
+	_ "image/gif"
+)
+
+// Sizes are the renditions that can be requested, as the longest side in pixels
+var Sizes = []int{128, 256, 512, 1024}
+
+const (
+	DefaultSize = 256
+
+	// MaxPixels bounds the memory a source image may take once decoded
+	MaxPixels = 25_000_000
+
+	jpegQuality = 85
+)
+
+var (
+	ErrUnsupported = errors.New("not a supported image")
+	ErrTooLarge    = errors.New("image is too large")
+)
+
+// ValidSize reports whether size is one of Sizes
+func ValidSize(size int) bool {
+	for _, s := range Sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Render decodes the JPEG, PNG or GIF image in r and writes it scaled to fit into
+// size x size pixels, as JPEG or as PNG when it is transparent. Smaller images keep
+// their size.
+func Render(w io.Writer, r io.ReadSeeker, size int) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return ErrUnsupported
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return ErrUnsupported
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return ErrTooLarge
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return ErrUnsupported
+	}
+
+	width, height := fit(src.Bounds().Dx(), src.Bounds().Dy(), size)
+	dst := scale(src, width, height)
+
+	if dst.Opaque() {
+		return jpeg.Encode(w, dst, &jpeg.Options{Quality: jpegQuality})
+	}
+	return png.Encode(w, dst)
+}
+
+// Helper functions
+
+// fit returns the dimensions of a width x height image scaled down to fit into size
+func fit(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(1, (height*size+width/2)/width)
+	}
+	return max(1, (width*size+height/2)/height), size
+}
+
+// scale resizes src to width x height. Each target pixel is the average of the
+// source pixels it covers, weighted by their alpha as the RGBA format premultiplies
+// it. The source is converted one band of rows at a time to keep memory low.
+func scale(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	band := image.NewRGBA(image.Rect(0, 0, srcWidth, (srcHeight+height-1)/height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := span(y, srcHeight, height)
+		rows := band.SubImage(image.Rect(0, 0, srcWidth, y1-y0)).(*image.RGBA)
+		draw.Draw(rows, rows.Bounds(), src, image.Pt(bounds.Min.X, bounds.Min.Y+y0), draw.Src)
+
+		for x := 0; x < width; x++ {
+			x0, x1 := span(x, srcWidth, width)
+
+			var r, g, b, a, n uint64
+			for sy := 0; sy < y1-y0; sy++ {
+				row := rows.Pix[sy*rows.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					b += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8((r + n/2) / n)
+			dst.Pix[i+1] = uint8((g + n/2) / n)
+			dst.Pix[i+2] = uint8((b + n/2) / n)
+			dst.Pix[i+3] = uint8((a + n/2) / n)
+		}
+	}
+
+	return dst
+}
+
+// span returns the source range the target index i covers, never empty
+func span(i, srcLength, length int) (int, int) {
+	start := i * srcLength / length
+	end := (i + 1) * srcLength / length
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
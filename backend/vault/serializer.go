@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm/schema"
+)
+
+const (
+	SerializerName = "vault"
+	textPrefix     = "yv1:"
+)
+
+var blobPrefix = []byte("YV1\x00")
+
+func init() {
+	schema.RegisterSerializer(SerializerName, Serializer{})
+}
+
+// Serializer transparently encrypts string and []byte columns tagged with
+// `gorm:"serializer:vault"` while vault mode is enabled. Values written before the
+// vault existed carry no prefix and are read back as plaintext.
+type Serializer struct{}
+
+// Scan implements schema.SerializerInterface
+func (Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var raw []byte
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("unsupported vault column value %T", dbValue)
+	}
+
+	plaintext, err := openColumn(raw)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", field.Name, err)
+	}
+
+	if field.FieldType.Kind() == reflect.String {
+		return field.Set(ctx, dst, string(plaintext))
+	}
+	if dbValue == nil {
+		return field.Set(ctx, dst, []byte(nil))
+	}
+	return field.Set(ctx, dst, plaintext)
+}
+
+// Value implements schema.SerializerValuerInterface
+func (Serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	switch v := fieldValue.(type) {
+	case string:
+		if v == "" || !Enabled() {
+			return v, nil
+		}
+		sealed, err := Seal([]byte(v))
+		if err != nil {
+			return nil, err
+		}
+		return textPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+	case []byte:
+		if len(v) == 0 || !Enabled() {
+			return v, nil
+		}
+		sealed, err := Seal(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, blobPrefix...), sealed...), nil
+	}
+	return nil, fmt.Errorf("unsupported vault field type %T", fieldValue)
+}
+
+func openColumn(raw []byte) ([]byte, error) {
+	isSealed := bytes.HasPrefix(raw, blobPrefix) || strings.HasPrefix(string(raw), textPrefix)
+	if isSealed && !Enabled() {
+		return nil, ErrNotEnabled
+	}
+
+	switch {
+	case bytes.HasPrefix(raw, blobPrefix):
+		return Open(raw[len(blobPrefix):])
+	case strings.HasPrefix(string(raw), textPrefix):
+		sealed, err := base64.StdEncoding.DecodeString(string(raw[len(textPrefix):]))
+		if err != nil {
+			return nil, err
+		}
+		return Open(sealed)
+	}
+	return raw, nil
+}
@@ -0,0 +1,170 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type secret struct {
+	ID   uint
+	Text string `gorm:"type:text;serializer:vault"`
+	Data []byte `gorm:"type:blob;serializer:vault"`
+}
+
+// storedSecret reads the columns as written, bypassing the serializer
+type storedSecret struct {
+	ID   uint
+	Text string
+	Data []byte
+}
+
+func (storedSecret) TableName() string {
+	return "secrets"
+}
+
+func TestSerializerWithoutVault(t *testing.T) {
+	db := openTestDB(t)
+	disableVault(t)
+
+	id := saveSecret(t, db, secret{Text: "hello", Data: []byte("world")})
+
+	stored := loadStoredSecret(t, db, id)
+	if stored.Text != "hello" || string(stored.Data) != "world" {
+		t.Errorf("stored %q and %q, want the plaintext", stored.Text, stored.Data)
+	}
+	checkSecret(t, db, id, "hello", []byte("world"))
+}
+
+func TestSerializerRoundTrip(t *testing.T) {
+	db := openTestDB(t)
+	enableVault(t)
+
+	id := saveSecret(t, db, secret{Text: "hello", Data: []byte("world")})
+
+	stored := loadStoredSecret(t, db, id)
+	if !strings.HasPrefix(stored.Text, textPrefix) || strings.Contains(stored.Text, "hello") {
+		t.Errorf("text stored as %q, want it sealed", stored.Text)
+	}
+	if !bytes.HasPrefix(stored.Data, blobPrefix) || bytes.Contains(stored.Data, []byte("world")) {
+		t.Errorf("data stored as %q, want it sealed", stored.Data)
+	}
+	checkSecret(t, db, id, "hello", []byte("world"))
+}
+
+func TestSerializerKeepsEmptyValues(t *testing.T) {
+	db := openTestDB(t)
+	enableVault(t)
+
+	id := saveSecret(t, db, secret{})
+
+	stored := loadStoredSecret(t, db, id)
+	if stored.Text != "" || len(stored.Data) != 0 {
+		t.Errorf("stored %q and %q, want empty values", stored.Text, stored.Data)
+	}
+	checkSecret(t, db, id, "", nil)
+}
+
+func TestSerializerReadsPlaintextFromBeforeTheVault(t *testing.T) {
+	db := openTestDB(t)
+	disableVault(t)
+	id := saveSecret(t, db, secret{Text: "hello", Data: []byte("world")})
+
+	enableVault(t)
+	checkSecret(t, db, id, "hello", []byte("world"))
+}
+
+func TestSerializerNeedsTheKey(t *testing.T) {
+	db := openTestDB(t)
+	dir := enableVault(t)
+	id := saveSecret(t, db, secret{Text: "hello", Data: []byte("world")})
+
+	// Loading the vault again leaves it locked
+	if err := Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	var locked secret
+	if err := db.First(&locked, id).Error; !errors.Is(err, ErrLocked) {
+		t.Errorf("reading with the vault locked: got %v, want ErrLocked", err)
+	}
+
+	disableVault(t)
+	var disabled secret
+	if err := db.First(&disabled, id).Error; !errors.Is(err, ErrNotEnabled) {
+		t.Errorf("reading without the vault: got %v, want ErrNotEnabled", err)
+	}
+}
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.sqlite")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := db.AutoMigrate(&secret{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// enableVault creates an unlocked vault in a new directory and returns it
+func enableVault(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := Create("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { disableVault(t) })
+	return dir
+}
+
+func disableVault(t *testing.T) {
+	t.Helper()
+	if err := Load(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func saveSecret(t *testing.T, db *gorm.DB, value secret) uint {
+	t.Helper()
+	if err := db.Create(&value).Error; err != nil {
+		t.Fatal(err)
+	}
+	return value.ID
+}
+
+func loadStoredSecret(t *testing.T, db *gorm.DB, id uint) storedSecret {
+	t.Helper()
+	var stored storedSecret
+	if err := db.First(&stored, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func checkSecret(t *testing.T, db *gorm.DB, id uint, text string, data []byte) {
+	t.Helper()
+	var loaded secret
+	if err := db.First(&loaded, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Text != text || !bytes.Equal(loaded.Data, data) {
+		t.Errorf("read back %q and %q, want %q and %q", loaded.Text, loaded.Data, text, data)
+	}
+}
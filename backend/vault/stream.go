@@ -0,0 +1,84 @@
+package vault
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"yana-back/crypt"
+)
+
+// streamMarker precedes files encrypted with the vault key, telling them apart from
+// files written before the vault existed and from streams under other keys
+const streamMarker = "YVS1"
+
+// contentHashContext derives the content hash key from the vault key
+const contentHashContext = "yana content hash"
+
+// NewWriter returns a writer that encrypts to w with the vault key, or writes through
+// without a vault. Close must be called to finish the stream; it does not close w.
+func NewWriter(w io.Writer) (io.WriteCloser, error) {
+	key, err := currentKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nopCloser{w}, nil
+	}
+
+	if _, err := io.WriteString(w, streamMarker); err != nil {
+		return nil, err
+	}
+	return crypt.NewWriter(key, w)
+}
+
+// NewReader reverses NewWriter; data written without a vault is read as is
+func NewReader(r crypt.SizedReader) (crypt.SizedReader, error) {
+	if !IsSealedStream(r) {
+		return io.NewSectionReader(r, 0, r.Size()), nil
+	}
+
+	key, err := currentKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrNotEnabled
+	}
+
+	size := r.Size() - int64(len(streamMarker))
+	return crypt.NewReader(key, io.NewSectionReader(r, int64(len(streamMarker)), size), size)
+}
+
+// IsSealedStream reports whether the data of r was written by NewWriter with a vault
+func IsSealedStream(r io.ReaderAt) bool {
+	marker := make([]byte, len(streamMarker))
+	n, _ := r.ReadAt(marker, 0)
+	return n == len(marker) && string(marker) == streamMarker
+}
+
+// ContentHash returns the hash that identifies identical file contents. With a vault
+// it is keyed, so the stored hashes do not reveal which known files are stored.
+func ContentHash() (hash.Hash, error) {
+	key, err := currentKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return sha256.New(), nil
+	}
+
+	hashKey := hmac.New(sha256.New, key)
+	hashKey.Write([]byte(contentHashContext))
+	return hmac.New(sha256.New, hashKey.Sum(nil)), nil
+}
+
+// Helper functions
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,232 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"yana-back/crypt"
+)
+
+const (
+	FileName    = "vault.json"
+	fileVersion = 1
+)
+
+var (
+	ErrLocked          = errors.New("vault is locked")
+	ErrNotEnabled      = errors.New("vault mode is not enabled")
+	ErrAlreadyEnabled  = errors.New("vault mode is already enabled")
+	ErrWrongPassphrase = errors.New("wrong vault passphrase")
+)
+
+// vaultFile is stored in the data directory; the data key is only ever written
+// wrapped under a key derived from the master passphrase
+type vaultFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// state holds the vault of the running backend
+var state struct {
+	sync.RWMutex
+	path string
+	file *vaultFile
+	key  []byte
+}
+
+// Load enables vault mode when the data directory contains a vault file; the vault
+// starts locked
+func Load(dataDir string) error {
+	path := filepath.Join(dataDir, FileName)
+
+	state.Lock()
+	defer state.Unlock()
+	state.path = path
+	state.file = nil
+	state.key = nil
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read vault file: %w", err)
+	}
+
+	var file vaultFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("failed to parse vault file: %w", err)
+	}
+	if file.Version != fileVersion {
+		return fmt.Errorf("unsupported vault file version %d", file.Version)
+	}
+
+	state.file = &file
+	return nil
+}
+
+// Enabled reports whether the data directory is a vault
+func Enabled() bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.file != nil
+}
+
+// Unlocked reports whether data can be read, which is always the case without a vault
+func Unlocked() bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.file == nil || state.key != nil
+}
+
+// Unlock opens the vault with the master passphrase
+func Unlock(passphrase string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.file == nil {
+		return ErrNotEnabled
+	}
+
+	key, err := unwrapKey(state.file, passphrase)
+	if err != nil {
+		return err
+	}
+
+	state.key = key
+	return nil
+}
+
+// Create turns the data directory into a vault protected by passphrase and leaves
+// it unlocked
+func Create(passphrase string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.file != nil {
+		return ErrAlreadyEnabled
+	}
+
+	key, err := crypt.RandomBytes(crypt.KeySize)
+	if err != nil {
+		return err
+	}
+
+	file, err := wrapKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(state.path, file); err != nil {
+		return err
+	}
+
+	state.file = file
+	state.key = key
+	return nil
+}
+
+// ChangePassphrase re-wraps the data key under a new passphrase; stored data does
+// not need to be re-encrypted
+func ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.file == nil {
+		return ErrNotEnabled
+	}
+
+	key, err := unwrapKey(state.file, oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	file, err := wrapKey(key, newPassphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(state.path, file); err != nil {
+		return err
+	}
+
+	state.file = file
+	state.key = key
+	return nil
+}
+
+// Seal encrypts data with the vault key; without a vault data is returned as is
+func Seal(data []byte) ([]byte, error) {
+	key, err := currentKey()
+	if err != nil || key == nil {
+		return data, err
+	}
+	return crypt.Seal(key, data)
+}
+
+// Open reverses Seal
+func Open(data []byte) ([]byte, error) {
+	key, err := currentKey()
+	if err != nil || key == nil {
+		return data, err
+	}
+	return crypt.Open(key, data)
+}
+
+// Helper functions
+
+func currentKey() ([]byte, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	if state.file == nil {
+		return nil, nil
+	}
+	if state.key == nil {
+		return nil, ErrLocked
+	}
+	return state.key, nil
+}
+
+func wrapKey(key []byte, passphrase string) (*vaultFile, error) {
+	salt, err := crypt.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := crypt.Seal(crypt.DeriveKey(passphrase, salt), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap vault key: %w", err)
+	}
+
+	return &vaultFile{Version: fileVersion, Salt: salt, WrappedKey: wrappedKey}, nil
+}
+
+func unwrapKey(file *vaultFile, passphrase string) ([]byte, error) {
+	key, err := crypt.Open(crypt.DeriveKey(passphrase, file.Salt), file.WrappedKey)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+func writeFile(path string, file *vaultFile) error {
+	raw, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode vault file: %w", err)
+	}
+
+	// Write then rename so a crash never leaves a half-written vault file behind
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write vault file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace vault file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"yana-back/config"
+	"yana-back/handlers"
+	"yana-back/models"
+	"yana-back/vault"
+
+	"golang.org/x/term"
+	"gorm.io/gorm"
+)
+
+const vaultUsage = "Usage: yana-back vault <init|passwd> [flags] <data dir>"
+
+// runVaultCommand handles `yana-back vault init` to turn an existing plaintext data
+// directory into a vault, and `yana-back vault passwd` to change its passphrase
+func runVaultCommand(args []string) {
+	if len(args) < 2 {
+		log.Fatal(vaultUsage)
+	}
+
+	cfg, err := config.Load(args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lock, err := lockDataDir(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var done, failed string
+	switch args[0] {
+	case "init":
+		err = initVault(cfg)
+		done, failed = "Vault created, the backend will start locked from now on", "Failed to create vault"
+	case "passwd":
+		err = changeVaultPassphrase(cfg)
+		done, failed = "Vault passphrase changed", "Failed to change vault passphrase"
+	default:
+		err = errors.New(vaultUsage)
+	}
+
+	// Clean up before exiting, log.Fatal skips deferred calls
+	closeDatabase()
+	lock.Release()
+
+	if err != nil {
+		if failed != "" {
+			log.Fatalf("%s: %v", failed, err)
+		}
+		log.Fatal(err)
+	}
+	log.Println(done)
+}
+
+func initVault(cfg config.Config) error {
+	if err := openDatabase(cfg); err != nil {
+		return err
+	}
+	if vault.Enabled() {
+		return vault.ErrAlreadyEnabled
+	}
+	if err := openBlobStore(cfg); err != nil {
+		return err
+	}
+
+	// Files still in the database are moved out first, so only the blob store needs
+	// converting
+	if err := handlers.MoveBlobsOutOfDatabase(context.Background()); err != nil {
+		return err
+	}
+
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+
+	if err := vault.Create(passphrase); err != nil {
+		return err
+	}
+
+	if err := encryptExistingData(handlers.DB); err != nil {
+		// Without the converted data the vault file would make the backend refuse a
+		// database it can still read, so drop it again
+		os.Remove(filepath.Join(cfg.DataDir, vault.FileName))
+		return err
+	}
+
+	// Blobs left unsealed by a failure stay readable and are sealed after the next
+	// unlock
+	if err := handlers.SealBlobsWithVault(context.Background()); err != nil {
+		return fmt.Errorf("failed to encrypt files: %w", err)
+	}
+
+	return nil
+}
+
+func changeVaultPassphrase(cfg config.Config) error {
+	if err := vault.Load(cfg.DataDir); err != nil {
+		return err
+	}
+	if !vault.Enabled() {
+		return vault.ErrNotEnabled
+	}
+
+	oldPassphrase, err := readPassphrase("Current vault passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	newPassphrase, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+
+	return vault.ChangePassphrase(oldPassphrase, newPassphrase)
+}
+
+// encryptExistingData rewrites every vault column so plaintext values get encrypted
+func encryptExistingData(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := resealRows[models.User](tx, "name", "nick_name", "hint", "profile_picture"); err != nil {
+			return fmt.Errorf("failed to encrypt users: %w", err)
+		}
+		if err := resealRows[models.Note](tx, "title", "content", "tag", "mood"); err != nil {
+			return fmt.Errorf("failed to encrypt notes: %w", err)
+		}
+		if err := resealRows[models.Document](tx, "name", "data"); err != nil {
+			return fmt.Errorf("failed to encrypt documents: %w", err)
+		}
+		if err := resealRows[models.NoteRevision](tx, "title", "content", "tag", "mood"); err != nil {
+			return fmt.Errorf("failed to encrypt revisions: %w", err)
+		}
+		if err := resealRows[models.RevisionDocument](tx, "name"); err != nil {
+			return fmt.Errorf("failed to encrypt revision documents: %w", err)
+		}
+		return nil
+	})
+}
+
+// resealRows reads rows in batches and writes the given columns back through the
+// vault serializer, leaving timestamps and hooks alone. Soft deleted rows are
+// included.
+func resealRows[T any](tx *gorm.DB, columns ...string) error {
+	var rows []T
+	return tx.Unscoped().FindInBatches(&rows, 50, func(batch *gorm.DB, _ int) error {
+		for i := range rows {
+			if err := batch.Unscoped().Model(&rows[i]).Select(columns).UpdateColumns(&rows[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+func readNewPassphrase() (string, error) {
+	passphrase, err := readPassphrase("New vault passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("the vault passphrase must not be empty")
+	}
+
+	confirmation, err := readPassphrase("Repeat the new vault passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirmation != passphrase {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase reads a line from stdin, without echoing it when stdin is a terminal
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		return string(passphrase), nil
+	}
+
+	// Piped input, e.g. from a script
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}